@@ -2,7 +2,11 @@ package main
 
 import (
 	"flag"
+	"net/http"
+	"os"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/retrieval"
 	log "github.com/sirupsen/logrus"
@@ -11,17 +15,38 @@ import (
 	"github.com/weaveworks/common/server"
 
 	"github.com/weaveworks-experiments/loki/pkg/api"
+	"github.com/weaveworks-experiments/loki/pkg/jaeger"
+	"github.com/weaveworks-experiments/loki/pkg/kafka"
+	"github.com/weaveworks-experiments/loki/pkg/otlp"
 	"github.com/weaveworks-experiments/loki/pkg/scraper"
 	"github.com/weaveworks-experiments/loki/pkg/storage"
 	"github.com/weaveworks-experiments/loki/pkg/zipkin-ui"
 )
 
+// newScraperFn makes scrapers appending the spans they scrape.
+func newScraperFn(appender scraper.Appender, id string) retrieval.ScraperFn {
+	return func(target *retrieval.Target, client *http.Client, _ model.LabelSet, _ *config.ScrapeConfig) retrieval.Scraper {
+		return scraper.New(appender, id, target, client)
+	}
+}
+
 func main() {
 	serverConfig := server.Config{
 		MetricsNamespace: "loki",
 	}
 	serverConfig.RegisterFlags(flag.CommandLine)
+	var storageConfig storage.Config
+	storageConfig.RegisterFlags(flag.CommandLine)
+	var kafkaConfig kafka.Config
+	kafkaConfig.RegisterFlags(flag.CommandLine)
+	var jaegerConfig jaeger.Config
+	jaegerConfig.RegisterFlags(flag.CommandLine)
 	configFile := flag.String("config.file", "loki.yml", "Loki configuration file name.")
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("Error getting hostname: %v", err)
+	}
+	scraperID := flag.String("scraper.id", hostname, "Identifies this Loki to the targets it scrapes; unique among replicas.")
 	flag.Parse()
 
 	if err := logging.Setup("info"); err != nil {
@@ -39,14 +64,38 @@ func main() {
 	}
 	defer server.Shutdown()
 
-	store := storage.NewSpanStore()
+	store, err := storage.New(storageConfig)
+	if err != nil {
+		log.Fatalf("Error creating storage: %v", err)
+	}
+	defer store.Close()
+	if collector, ok := store.(prometheus.Collector); ok {
+		prometheus.MustRegister(collector)
+	}
 
-	targetManager := retrieval.NewTargetManager(scraper.NewScraperFn(store))
+	targetManager := retrieval.NewTargetManager(newScraperFn(store, *scraperID))
 	targetManager.ApplyConfig(config)
 	go targetManager.Run()
 	defer targetManager.Stop()
 
+	if kafkaConfig.Brokers != "" {
+		ingester, err := kafka.New(kafkaConfig, store)
+		if err != nil {
+			log.Fatalf("Error creating Kafka ingester: %v", err)
+		}
+		defer ingester.Stop()
+	}
+
+	if jaegerConfig.Addr != "" {
+		agent, err := jaeger.NewAgent(jaegerConfig, store)
+		if err != nil {
+			log.Fatalf("Error creating Jaeger agent: %v", err)
+		}
+		defer agent.Stop()
+	}
+
 	api.Register(server.HTTP, store)
+	otlp.RegisterTraceService(server.GRPC, otlp.NewTraceService(store))
 	server.HTTP.PathPrefix("/").Handler(ui.Handler)
 	server.Run()
 }
@@ -1,20 +1,32 @@
 package api
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
 	log "github.com/sirupsen/logrus"
 
+	client "github.com/weaveworks-experiments/loki/pkg/client"
+	"github.com/weaveworks-experiments/loki/pkg/model"
+	"github.com/weaveworks-experiments/loki/pkg/otlp"
 	"github.com/weaveworks-experiments/loki/pkg/storage"
 )
 
 const (
 	defaultWindowMS = 60 * 60 * 1000
+
+	// The largest batch of spans we'll accept in one POST.
+	maxSpansBodyBytes = 10 << 20
 )
 
 func parseInt64(values url.Values, key string, def int64) (int64, error) {
@@ -31,72 +43,170 @@ func parseInt64(values url.Values, key string, def int64) (int64, error) {
 	return intVal, nil
 }
 
-func Register(router *mux.Router, store storage.SpanStore) {
-	router.Handle("/api/v1/dependencies", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if err := json.NewEncoder(w).Encode(struct{}{}); err != nil {
-			log.Errorf("Error marshalling: %v", err)
+// parseAnnotationQuery parses Zipkin's annotationQuery, which is a list of
+// terms separated by " and ".  Terms of the form key=value match tag values;
+// other terms match annotations or tag keys.
+func parseAnnotationQuery(value string) ([]string, map[string]string) {
+	var annotations []string
+	binaryAnnotations := map[string]string{}
+	for _, term := range strings.Split(value, " and ") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
 		}
-	}))
+		if i := strings.Index(term, "="); i > 0 {
+			binaryAnnotations[term[:i]] = term[i+1:]
+		} else {
+			annotations = append(annotations, term)
+		}
+	}
+	return annotations, binaryAnnotations
+}
 
-	router.Handle("/config.json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if err := json.NewEncoder(w).Encode(struct {
-			DefaultLookback int `json:"defaultLookback"`
-			QueryLimit      int `json:"queryLimit"`
-		}{
-			DefaultLookback: 3600000,
-			QueryLimit:      10,
-		}); err != nil {
-			log.Errorf("Error marshalling config: %v", err)
+// parseTracesQuery parses the parameters shared by the v1 and v2 traces
+// endpoints.
+func parseTracesQuery(values url.Values) (storage.Query, error) {
+	nowMS := time.Now().UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond))
+
+	endTS, err := parseInt64(values, "endTs", nowMS)
+	if err != nil {
+		return storage.Query{}, err
+	}
+
+	lookback, err := parseInt64(values, "lookback", defaultWindowMS)
+	if err != nil {
+		return storage.Query{}, err
+	}
+
+	minDuration, err := parseInt64(values, "minDuration", 0)
+	if err != nil {
+		return storage.Query{}, err
+	}
+
+	maxDuration, err := parseInt64(values, "maxDuration", 0)
+	if err != nil {
+		return storage.Query{}, err
+	}
+
+	sort, err := storage.ParseSortOrder(values.Get("sort"))
+	if err != nil {
+		return storage.Query{}, err
+	}
+
+	limit, err := parseInt64(values, "limit", 10)
+	if err != nil {
+		return storage.Query{}, err
+	}
+
+	annotations, binaryAnnotations := parseAnnotationQuery(values.Get("annotationQuery"))
+
+	return storage.Query{
+		EndMS:             endTS,
+		StartMS:           endTS - lookback,
+		Limit:             int(limit),
+		ServiceName:       values.Get("serviceName"),
+		SpanName:          values.Get("spanName"),
+		MinDurationUS:     minDuration,
+		MaxDurationUS:     maxDuration,
+		Sort:              sort,
+		Annotations:       annotations,
+		BinaryAnnotations: binaryAnnotations,
+	}, nil
+}
+
+// spansDecoder decodes the body of a POST of spans.
+type spansDecoder func(io.Reader) ([]*zipkincore.Span, error)
+
+// postSpansHandler lets services which can't be scraped POST their spans to
+// us instead, decoded according to their content type.
+func postSpansHandler(store storage.SpanStore, decoders map[string]spansDecoder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := io.Reader(http.MaxBytesReader(w, r.Body, maxSpansBodyBytes))
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			body = io.LimitReader(gz, maxSpansBodyBytes)
 		}
-	}))
 
-	router.Handle("/api/v1/services", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		services, err := store.Services()
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		decode, ok := decoders[mediaType]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unsupported content type %q", mediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+		spans, err := decode(body)
 		if err != nil {
-			log.Errorf("Store error: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if err := json.NewEncoder(w).Encode(services); err != nil {
-			log.Errorf("Error marshalling: %v", err)
+
+		for _, span := range spans {
+			if err := store.Append(span); err != nil {
+				log.Errorf("Store error: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 		}
-	}))
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
 
-	router.Handle("/api/v1/spans", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		values := r.URL.Query()
-		serviceName := values.Get("serviceName")
-		if serviceName == "" {
-			http.Error(w, "serviceName required", http.StatusBadRequest)
+// traceHandler serves a trace, converted to the wire format by toWire.
+func traceHandler(store storage.SpanStore, toWire func([]*zipkincore.Span) interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := model.ParseTraceID(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Not found", http.StatusNotFound)
 			return
 		}
-		spanNames, err := store.SpanNames(serviceName)
-		if err != nil {
+
+		trace, err := store.Trace(id)
+		if err == storage.ErrNotFound {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		} else if err != nil {
 			log.Errorf("Store error: %v", err)
 			return
 		}
-		if err := json.NewEncoder(w).Encode(spanNames); err != nil {
+
+		if err := json.NewEncoder(w).Encode(toWire(trace.Spans)); err != nil {
 			log.Errorf("Error marshalling: %v", err)
 		}
-	}))
+	})
+}
 
-	router.Handle("/api/v1/trace/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		id, err := fromIDStr(mux.Vars(r)["id"])
+// tracesHandler serves trace queries, converted to the wire format by toWire.
+// Zipkin v1 requires a serviceName, whereas v2 doesn't.
+func tracesHandler(store storage.SpanStore, requireServiceName bool, toWire func([]storage.Trace) interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := parseTracesQuery(r.URL.Query())
 		if err != nil {
-			http.Error(w, "Not found", http.StatusNotFound)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if requireServiceName && query.ServiceName == "" {
+			http.Error(w, "serviceName required", http.StatusBadRequest)
 			return
 		}
 
-		trace, err := store.Trace(id)
+		traces, err := store.Traces(query)
 		if err != nil {
 			log.Errorf("Store error: %v", err)
 			return
 		}
 
-		if err := json.NewEncoder(w).Encode(SpansToWire(trace.Spans)); err != nil {
+		if err := json.NewEncoder(w).Encode(toWire(traces)); err != nil {
 			log.Errorf("Error marshalling: %v", err)
 		}
-	}))
+	})
+}
 
-	router.Handle("/api/v1/traces", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+func Register(router *mux.Router, store storage.SpanStore) {
+	dependencies := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		nowMS := time.Now().UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond))
 		values := r.URL.Query()
 
@@ -106,46 +216,94 @@ func Register(router *mux.Router, store storage.SpanStore) {
 			return
 		}
 
-		lookback, err := parseInt64(values, "lookback", defaultWindowMS)
+		lookback, err := parseInt64(values, "lookback", endTS)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		minDuration, err := parseInt64(values, "minDuration", 0)
+		links, err := store.Dependencies(endTS-lookback, endTS)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Errorf("Store error: %v", err)
 			return
 		}
 
-		limit, err := parseInt64(values, "limit", 10)
+		if err := json.NewEncoder(w).Encode(DependenciesToWire(links)); err != nil {
+			log.Errorf("Error marshalling: %v", err)
+		}
+	})
+	router.Handle("/api/v1/dependencies", dependencies)
+	router.Handle("/api/v2/dependencies", dependencies)
+
+	router.Handle("/config.json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewEncoder(w).Encode(struct {
+			DefaultLookback int `json:"defaultLookback"`
+			QueryLimit      int `json:"queryLimit"`
+		}{
+			DefaultLookback: 3600000,
+			QueryLimit:      10,
+		}); err != nil {
+			log.Errorf("Error marshalling config: %v", err)
+		}
+	}))
+
+	services := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		services, err := store.Services()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Errorf("Store error: %v", err)
 			return
 		}
+		if err := json.NewEncoder(w).Encode(services); err != nil {
+			log.Errorf("Error marshalling: %v", err)
+		}
+	})
+	router.Handle("/api/v1/services", services)
+	router.Handle("/api/v2/services", services)
 
+	spanNames := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := r.URL.Query()
 		serviceName := values.Get("serviceName")
 		if serviceName == "" {
 			http.Error(w, "serviceName required", http.StatusBadRequest)
 			return
 		}
-
-		query := storage.Query{
-			EndMS:         endTS,
-			StartMS:       endTS - lookback,
-			Limit:         int(limit),
-			ServiceName:   serviceName,
-			SpanName:      values.Get("spanName"),
-			MinDurationUS: minDuration,
-		}
-		traces, err := store.Traces(query)
+		spanNames, err := store.SpanNames(serviceName)
 		if err != nil {
 			log.Errorf("Store error: %v", err)
 			return
 		}
-
-		if err := json.NewEncoder(w).Encode(TracesToWire(traces)); err != nil {
+		if err := json.NewEncoder(w).Encode(spanNames); err != nil {
 			log.Errorf("Error marshalling: %v", err)
 		}
+	})
+	router.Handle("/api/v1/spans", spanNames).Methods("GET")
+	router.Handle("/api/v2/spans", spanNames).Methods("GET")
+
+	// v1 accepts thrift, encoded like the scraped /traces endpoints, or JSON.
+	router.Handle("/api/v1/spans", postSpansHandler(store, map[string]spansDecoder{
+		"application/x-thrift": client.ReadSpans,
+		"application/json":     model.ZipkinSpansFromJSON,
+		"":                     model.ZipkinSpansFromJSON,
+	})).Methods("POST")
+	router.Handle("/api/v2/spans", postSpansHandler(store, map[string]spansDecoder{
+		"application/json": SpansFromV2Wire,
+		"":                 SpansFromV2Wire,
+	})).Methods("POST")
+	router.Handle("/v1/traces", postSpansHandler(store, map[string]spansDecoder{
+		"application/x-protobuf": otlp.SpansFromProtobuf,
+	})).Methods("POST")
+
+	router.Handle("/api/v1/trace/{id}", traceHandler(store, func(spans []*zipkincore.Span) interface{} {
+		return SpansToWire(spans)
+	}))
+	router.Handle("/api/v2/trace/{id}", traceHandler(store, func(spans []*zipkincore.Span) interface{} {
+		return spansToV2Wire(spans)
+	}))
+
+	router.Handle("/api/v1/traces", tracesHandler(store, true, func(traces []storage.Trace) interface{} {
+		return TracesToWire(traces)
+	}))
+	router.Handle("/api/v2/traces", tracesHandler(store, false, func(traces []storage.Trace) interface{} {
+		return tracesToV2Wire(traces)
 	}))
 }
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/mux"
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+
+	client "github.com/weaveworks-experiments/loki/pkg/client"
+	"github.com/weaveworks-experiments/loki/pkg/otlp"
+	"github.com/weaveworks-experiments/loki/pkg/storage"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, storage.SpanStore) {
+	store, err := storage.NewSpanStore(storage.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	Register(router, store)
+	return httptest.NewServer(router), store
+}
+
+func post(t *testing.T, url, contentType string, body []byte) {
+	resp, err := http.Post(url, contentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST %s: %s", contentType, resp.Status)
+	}
+}
+
+func TestPostOTLP(t *testing.T) {
+	server, store := newTestServer(t)
+	defer server.Close()
+	defer store.Close()
+
+	service := "otel"
+	buf, err := proto.Marshal(&otlp.ExportTraceServiceRequest{
+		ResourceSpans: []*otlp.ResourceSpans{{
+			Resource: &otlp.Resource{Attributes: []*otlp.KeyValue{
+				{Key: "service.name", Value: &otlp.AnyValue{StringValue: &service}},
+			}},
+			ScopeSpans: []*otlp.ScopeSpans{{
+				Spans: []*otlp.Span{{
+					TraceID:           []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5},
+					SpanID:            []byte{0, 0, 0, 0, 0, 0, 0, 6},
+					Name:              "export",
+					StartTimeUnixNano: 1000000000,
+					EndTimeUnixNano:   1001000000,
+				}},
+			}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	post(t, server.URL+"/v1/traces", "application/x-protobuf", buf)
+
+	var spans []v2Span
+	getJSON(t, server.URL+"/api/v2/trace/0000000000000005", &spans)
+	if len(spans) != 1 || spans[0].Name != "export" || spans[0].Duration != 1000 || spans[0].LocalEndpoint.ServiceName != "otel" {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+}
+
+func TestPostSpans(t *testing.T) {
+	server, store := newTestServer(t)
+	defer server.Close()
+	defer store.Close()
+
+	post(t, server.URL+"/api/v1/spans", "application/json", []byte(`[{
+		"traceId": "1", "id": "a", "name": "get", "timestamp": 1000000, "duration": 10,
+		"annotations": [{"timestamp": 1000000, "value": "sr", "endpoint": {"serviceName": "web", "ipv4": "10.0.0.1", "port": 40000}}],
+		"binaryAnnotations": [
+			{"key": "http.path", "value": "/", "endpoint": {"serviceName": "web"}},
+			{"key": "http.status_code", "value": 200, "type": "I32", "endpoint": {"serviceName": "web"}},
+			{"key": "retries", "value": 3, "endpoint": {"serviceName": "web"}},
+			{"key": "load", "value": 0.5, "endpoint": {"serviceName": "web"}}
+		]
+	}]`))
+
+	endpoint := zipkincore.NewEndpoint()
+	endpoint.ServiceName = "api"
+	parentID, timestamp := int64(0xa), int64(1000001)
+	var buf bytes.Buffer
+	if err := client.WriteSpans([]*zipkincore.Span{{
+		TraceID:     1,
+		ID:          0xb,
+		ParentID:    &parentID,
+		Name:        "list",
+		Timestamp:   &timestamp,
+		Annotations: []*zipkincore.Annotation{{Timestamp: timestamp, Value: "sr", Host: endpoint}},
+	}}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	post(t, server.URL+"/api/v1/spans", "application/x-thrift", buf.Bytes())
+
+	resp, err := http.Get(server.URL + "/api/v1/trace/0000000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var spans []struct {
+		Name        string `json:"name"`
+		Annotations []struct {
+			Endpoint struct {
+				Port uint16 `json:"port"`
+			} `json:"endpoint"`
+		} `json:"annotations"`
+		BinaryAnnotations []struct {
+			Key   string      `json:"key"`
+			Value interface{} `json:"value"`
+		} `json:"binaryAnnotations"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&spans); err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 2 || spans[0].Name != "get" || spans[1].Name != "list" {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+	if annotations := spans[0].Annotations; len(annotations) != 1 || annotations[0].Endpoint.Port != 40000 {
+		t.Fatalf("unexpected annotations: %+v", annotations)
+	}
+	if annotations := spans[0].BinaryAnnotations; len(annotations) != 4 || annotations[1].Value != float64(200) ||
+		annotations[2].Value != float64(3) || annotations[3].Value != 0.5 {
+		t.Fatalf("unexpected binary annotations: %+v", annotations)
+	}
+
+	resp, err = http.Post(server.URL+"/api/v1/spans", "application/json", strings.NewReader(`[{"traceId": "xyz"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a bad request for an invalid ID, got %s", resp.Status)
+	}
+}
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestV2RoundTrip(t *testing.T) {
+	server, store := newTestServer(t)
+	defer server.Close()
+	defer store.Close()
+
+	post(t, server.URL+"/api/v2/spans", "application/json", []byte(`[
+		{"traceId": "2", "id": "c", "parentId": "b", "kind": "CLIENT", "name": "get", "timestamp": 1000000, "duration": 100,
+		 "localEndpoint": {"serviceName": "web", "ipv4": "10.0.0.1"}, "remoteEndpoint": {"serviceName": "api"},
+		 "tags": {"http.path": "/users"}},
+		{"traceId": "2", "id": "c", "parentId": "b", "kind": "SERVER", "name": "get", "timestamp": 1000010, "duration": 80, "shared": true,
+		 "localEndpoint": {"serviceName": "api"}, "annotations": [{"timestamp": 1000020, "value": "cache miss"}]}
+	]`))
+
+	var spans []v2Span
+	getJSON(t, server.URL+"/api/v2/trace/2", &spans)
+	want := []v2Span{
+		{
+			TraceID: "0000000000000002", ParentID: "000000000000000b", ID: "000000000000000c",
+			Kind: "CLIENT", Name: "get", Timestamp: 1000000, Duration: 100,
+			LocalEndpoint:  &v2Endpoint{ServiceName: "web", Ipv4: "10.0.0.1"},
+			RemoteEndpoint: &v2Endpoint{ServiceName: "api"},
+			Tags:           map[string]string{"http.path": "/users"},
+		},
+		{
+			TraceID: "0000000000000002", ParentID: "000000000000000b", ID: "000000000000000c",
+			Kind: "SERVER", Name: "get", Timestamp: 1000010, Duration: 80, Shared: true,
+			LocalEndpoint: &v2Endpoint{ServiceName: "api"},
+			Annotations:   []v2Annotation{{Timestamp: 1000020, Value: "cache miss"}},
+		},
+	}
+	if !reflect.DeepEqual(want, spans) {
+		t.Fatalf("want %+v, have %+v", want, spans)
+	}
+
+	var traces [][]v2Span
+	getJSON(t, server.URL+"/api/v2/traces?endTs=2000&lookback=2000&annotationQuery=http.path%3D%2Fusers", &traces)
+	if len(traces) != 1 || len(traces[0]) != 2 {
+		t.Fatalf("unexpected traces: %+v", traces)
+	}
+
+	var services []string
+	getJSON(t, server.URL+"/api/v2/services", &services)
+	if want := []string{"api", "web"}; !reflect.DeepEqual(want, services) {
+		t.Fatalf("want %v, have %v", want, services)
+	}
+}
+
+func TestTraceID128(t *testing.T) {
+	server, store := newTestServer(t)
+	defer server.Close()
+	defer store.Close()
+
+	// Two traces sharing their low 64 bits must not be merged.
+	post(t, server.URL+"/api/v2/spans", "application/json", []byte(`[
+		{"traceId": "463ac35c9f6413ad48485a3953bb6124", "id": "1", "name": "get", "timestamp": 1000000, "duration": 100,
+		 "localEndpoint": {"serviceName": "web"}},
+		{"traceId": "48485a3953bb6124", "id": "2", "name": "put", "timestamp": 1000000, "duration": 100,
+		 "localEndpoint": {"serviceName": "web"}}
+	]`))
+
+	var spans []v2Span
+	getJSON(t, server.URL+"/api/v2/trace/463ac35c9f6413ad48485a3953bb6124", &spans)
+	if len(spans) != 1 || spans[0].TraceID != "463ac35c9f6413ad48485a3953bb6124" || spans[0].Name != "get" {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+	getJSON(t, server.URL+"/api/v2/trace/48485a3953bb6124", &spans)
+	if len(spans) != 1 || spans[0].TraceID != "48485a3953bb6124" || spans[0].Name != "put" {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+}
+
+func TestEndpointlessSpans(t *testing.T) {
+	server, store := newTestServer(t)
+	defer server.Close()
+	defer store.Close()
+
+	post(t, server.URL+"/api/v1/spans", "application/json", []byte(`[{
+		"traceId": "3", "id": "a", "name": "get", "timestamp": 1000000, "duration": 10,
+		"annotations": [{"timestamp": 1000000, "value": "sr"}],
+		"binaryAnnotations": [{"key": "http.path", "value": "/"}]
+	}]`))
+	post(t, server.URL+"/api/v2/spans", "application/json", []byte(`[
+		{"traceId": "3", "id": "b", "parentId": "a", "kind": "CLIENT", "name": "list", "timestamp": 1000001, "duration": 5}
+	]`))
+
+	// A value too short for its type is read back as bytes.
+	var buf bytes.Buffer
+	if err := client.WriteSpans([]*zipkincore.Span{{
+		TraceID:           3,
+		ID:                0xc,
+		Name:              "put",
+		BinaryAnnotations: []*zipkincore.BinaryAnnotation{{Key: "size", Value: []byte{1}, AnnotationType: zipkincore.AnnotationType_I64}},
+	}}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	post(t, server.URL+"/api/v1/spans", "application/x-thrift", buf.Bytes())
+
+	var spans []map[string]interface{}
+	getJSON(t, server.URL+"/api/v1/trace/0000000000000003", &spans)
+	if len(spans) != 3 {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+	for _, span := range spans {
+		for _, field := range []string{"annotations", "binaryAnnotations"} {
+			for _, annotation := range span[field].([]interface{}) {
+				if _, ok := annotation.(map[string]interface{})["endpoint"]; ok {
+					t.Fatalf("expected no endpoint, got %+v", annotation)
+				}
+			}
+		}
+	}
+}
@@ -3,27 +3,16 @@ package api
 import (
 	"encoding/binary"
 	"encoding/hex"
-	"fmt"
 	"math"
 	"net"
 	_ "unsafe" // For math.Float64frombits
 
 	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
 
+	"github.com/weaveworks-experiments/loki/pkg/model"
 	"github.com/weaveworks-experiments/loki/pkg/storage"
 )
 
-func fromIDStr(id string) (int64, error) {
-	bytes, err := hex.DecodeString(id)
-	if err != nil {
-		return 0, err
-	}
-	if len(bytes) != 8 {
-		return 0, fmt.Errorf("Invalid id")
-	}
-	return int64(binary.BigEndian.Uint64(bytes)), nil
-}
-
 func idStr(id *int64) string {
 	if id == nil {
 		return ""
@@ -34,55 +23,69 @@ func idStr(id *int64) string {
 	return hex.EncodeToString(idBytes[:])
 }
 
+// endpointToWire returns nil for spans stored without a host, so their
+// annotations are written without an endpoint.
 func endpointToWire(endpoint *zipkincore.Endpoint) interface{} {
+	if endpoint == nil {
+		return nil
+	}
 	var ipaddr [4]byte
 	binary.BigEndian.PutUint32(ipaddr[:], uint32(endpoint.Ipv4))
 
 	return struct {
 		ServiceName string `json:"serviceName"`
 		Ipv4        string `json:"ipv4"`
-		Port        int16  `json:"port"`
+		Port        uint16 `json:"port"`
 	}{
 		ServiceName: endpoint.ServiceName,
 		Ipv4:        net.IP(ipaddr[:]).String(),
-		Port:        endpoint.Port,
+		Port:        uint16(endpoint.Port),
 	}
 }
 
-func binaryAnnotationToWire(annotation *zipkincore.BinaryAnnotation) interface{} {
-	var value interface{}
+// binaryAnnotationValueToWire decodes a big-endian value.  Values too short
+// for their type are written as bytes.
+func binaryAnnotationValueToWire(annotation *zipkincore.BinaryAnnotation) interface{} {
+	value := annotation.Value
 	switch annotation.AnnotationType {
 	case zipkincore.AnnotationType_BOOL:
-		value = len(annotation.Value) > 0 && annotation.Value[0] == '\x01'
-
-	case zipkincore.AnnotationType_BYTES:
-		value = annotation.Value
+		return len(value) > 0 && value[0] == '\x01'
 
 	case zipkincore.AnnotationType_I16:
-		value = int16(binary.BigEndian.Uint16(annotation.Value))
+		if len(value) >= 2 {
+			return int16(binary.BigEndian.Uint16(value))
+		}
 
 	case zipkincore.AnnotationType_I32:
-		value = int32(binary.BigEndian.Uint32(annotation.Value))
+		if len(value) >= 4 {
+			return int32(binary.BigEndian.Uint32(value))
+		}
 
 	case zipkincore.AnnotationType_I64:
-		value = int64(binary.BigEndian.Uint64(annotation.Value))
+		if len(value) >= 8 {
+			return int64(binary.BigEndian.Uint64(value))
+		}
 
 	case zipkincore.AnnotationType_DOUBLE:
-		b := binary.BigEndian.Uint64(annotation.Value)
-		value = math.Float64frombits(b)
+		if len(value) >= 8 {
+			return math.Float64frombits(binary.BigEndian.Uint64(value))
+		}
 
 	case zipkincore.AnnotationType_STRING:
-		value = string(annotation.Value)
+		return string(value)
 	}
+	return value
+}
 
+func binaryAnnotationToWire(annotation *zipkincore.BinaryAnnotation) interface{} {
 	return struct {
-		Endpoint interface{} `json:"endpoint"`
+		Endpoint interface{} `json:"endpoint,omitempty"`
 		Key      string      `json:"key"`
 		Value    interface{} `json:"value"`
 	}{
 		Endpoint: endpointToWire(annotation.Host),
 		Key:      annotation.Key,
-		Value:    value,
+		Value:    binaryAnnotationValueToWire(annotation),
 	}
 
 }
@@ -97,7 +100,7 @@ func binaryAnnotationsToWire(annotations []*zipkincore.BinaryAnnotation) []inter
 
 func annotationToWire(annotation *zipkincore.Annotation) interface{} {
 	return struct {
-		Endpoint  interface{} `json:"endpoint"`
+		Endpoint  interface{} `json:"endpoint,omitempty"`
 		Timestamp int64       `json:"timestamp"`
 		Value     interface{} `json:"value"`
 	}{
@@ -126,7 +129,7 @@ func spanToWire(span *zipkincore.Span) interface{} {
 		Annotations       []interface{} `json:"annotations"`
 		BinaryAnnotations []interface{} `json:"binaryAnnotations"`
 	}{
-		TraceID:           idStr(&span.TraceID),
+		TraceID:           model.ZipkinTraceID(span).String(),
 		Name:              span.Name,
 		ID:                idStr(&span.ID),
 		ParentID:          idStr(span.ParentID),
@@ -152,3 +155,21 @@ func TracesToWire(traces []storage.Trace) [][]interface{} {
 	}
 	return result
 }
+
+func DependenciesToWire(links []storage.DependencyLink) []interface{} {
+	result := make([]interface{}, 0, len(links))
+	for _, link := range links {
+		result = append(result, struct {
+			Parent     string `json:"parent"`
+			Child      string `json:"child"`
+			CallCount  int64  `json:"callCount"`
+			ErrorCount int64  `json:"errorCount"`
+		}{
+			Parent:     link.Parent,
+			Child:      link.Child,
+			CallCount:  link.CallCount,
+			ErrorCount: link.ErrorCount,
+		})
+	}
+	return result
+}
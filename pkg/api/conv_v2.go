@@ -0,0 +1,197 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sort"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
+	"github.com/weaveworks-experiments/loki/pkg/storage"
+)
+
+// Zipkin v2 spans map directly onto Loki's own span model.  Spans are stored
+// in the v1 thrift model, so are converted on the way in and out, as Zipkin
+// itself does.
+
+type v2Endpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	Ipv4        string `json:"ipv4,omitempty"`
+	Ipv6        string `json:"ipv6,omitempty"`
+	Port        uint16 `json:"port,omitempty"`
+}
+
+type v2Annotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+type v2Span struct {
+	TraceID        string            `json:"traceId"`
+	ParentID       string            `json:"parentId,omitempty"`
+	ID             string            `json:"id"`
+	Kind           string            `json:"kind,omitempty"`
+	Name           string            `json:"name,omitempty"`
+	Timestamp      int64             `json:"timestamp,omitempty"`
+	Duration       int64             `json:"duration,omitempty"`
+	Debug          bool              `json:"debug,omitempty"`
+	Shared         bool              `json:"shared,omitempty"`
+	LocalEndpoint  *v2Endpoint       `json:"localEndpoint,omitempty"`
+	RemoteEndpoint *v2Endpoint       `json:"remoteEndpoint,omitempty"`
+	Annotations    []v2Annotation    `json:"annotations,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+}
+
+func endpointToV2(endpoint *model.Endpoint) *v2Endpoint {
+	if endpoint == nil {
+		return nil
+	}
+	result := &v2Endpoint{
+		ServiceName: endpoint.ServiceName,
+		Port:        endpoint.Port,
+	}
+	if endpoint.IPv4 != nil {
+		result.Ipv4 = endpoint.IPv4.String()
+	}
+	if endpoint.IPv6 != nil {
+		result.Ipv6 = endpoint.IPv6.String()
+	}
+	return result
+}
+
+func endpointFromV2(endpoint *v2Endpoint) *model.Endpoint {
+	if endpoint == nil {
+		return nil
+	}
+	result := &model.Endpoint{
+		ServiceName: endpoint.ServiceName,
+		Port:        endpoint.Port,
+	}
+	if ip := net.ParseIP(endpoint.Ipv4).To4(); ip != nil {
+		result.IPv4 = ip
+	}
+	if ip := net.ParseIP(endpoint.Ipv6); ip != nil && ip.To4() == nil {
+		result.IPv6 = ip
+	}
+	return result
+}
+
+func spanToV2(span *model.Span) v2Span {
+	result := v2Span{
+		TraceID:        span.TraceID.String(),
+		ID:             span.ID.String(),
+		Kind:           span.Kind.String(),
+		Name:           span.Name,
+		Timestamp:      span.Timestamp,
+		Duration:       span.Duration,
+		Debug:          span.Debug,
+		Shared:         span.Shared,
+		LocalEndpoint:  endpointToV2(span.LocalEndpoint),
+		RemoteEndpoint: endpointToV2(span.RemoteEndpoint),
+		Tags:           map[string]string{},
+	}
+	if span.ParentID != 0 {
+		result.ParentID = span.ParentID.String()
+	}
+	for _, event := range span.Events {
+		result.Annotations = append(result.Annotations, v2Annotation{
+			Timestamp: event.Timestamp,
+			Value:     event.Name,
+		})
+	}
+	for _, tag := range span.Tags {
+		result.Tags[tag.Key] = tag.ValueString()
+	}
+	return result
+}
+
+func spanFromV2(span v2Span) (*model.Span, error) {
+	traceID, err := model.ParseTraceID(span.TraceID)
+	if err != nil {
+		return nil, err
+	}
+	id, err := model.ParseSpanID(span.ID)
+	if err != nil {
+		return nil, err
+	}
+	var parentID model.SpanID
+	if span.ParentID != "" {
+		if parentID, err = model.ParseSpanID(span.ParentID); err != nil {
+			return nil, err
+		}
+	}
+	kind, err := model.ParseKind(span.Kind)
+	if err != nil {
+		return nil, err
+	}
+	result := &model.Span{
+		TraceID:        traceID,
+		ID:             id,
+		ParentID:       parentID,
+		Name:           span.Name,
+		Kind:           kind,
+		Timestamp:      span.Timestamp,
+		Duration:       span.Duration,
+		Shared:         span.Shared,
+		Debug:          span.Debug,
+		LocalEndpoint:  endpointFromV2(span.LocalEndpoint),
+		RemoteEndpoint: endpointFromV2(span.RemoteEndpoint),
+	}
+	for _, annotation := range span.Annotations {
+		result.Events = append(result.Events, model.Event{
+			Timestamp: annotation.Timestamp,
+			Name:      annotation.Value,
+		})
+	}
+	keys := make([]string, 0, len(span.Tags))
+	for key := range span.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Tags = append(result.Tags, model.StringTag(key, span.Tags[key]))
+	}
+	return result, nil
+}
+
+// spansToV2Wire converts spans to v2, ordered by their v2 timestamps; shared
+// spans have no timestamp in v1, so the stored order isn't right.
+func spansToV2Wire(spans []*zipkincore.Span) []v2Span {
+	result := make([]v2Span, 0, len(spans))
+	for _, span := range spans {
+		for _, s := range model.FromZipkin(span) {
+			result = append(result, spanToV2(s))
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Timestamp < result[j].Timestamp
+	})
+	return result
+}
+
+func tracesToV2Wire(traces []storage.Trace) [][]v2Span {
+	result := make([][]v2Span, 0, len(traces))
+	for _, trace := range traces {
+		result = append(result, spansToV2Wire(trace.Spans))
+	}
+	return result
+}
+
+// SpansFromV2Wire decodes a Zipkin v2 JSON list of spans.
+func SpansFromV2Wire(r io.Reader) ([]*zipkincore.Span, error) {
+	var spans []v2Span
+	if err := json.NewDecoder(r).Decode(&spans); err != nil {
+		return nil, err
+	}
+	result := make([]*zipkincore.Span, 0, len(spans))
+	for _, span := range spans {
+		s, err := spanFromV2(span)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, model.ToZipkin(s))
+	}
+	return result, nil
+}
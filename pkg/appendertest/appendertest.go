@@ -0,0 +1,51 @@
+// Package appendertest provides an appender for testing the packages which
+// ingest spans.
+package appendertest
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+)
+
+// Appender records the spans appended to it.
+type Appender struct {
+	Failures int // how many appends to fail first
+
+	mtx   sync.Mutex
+	spans []*zipkincore.Span
+}
+
+// Append records span, unless it's failing.
+func (a *Appender) Append(span *zipkincore.Span) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.Failures > 0 {
+		a.Failures--
+		return errors.New("append failed")
+	}
+	a.spans = append(a.spans, span)
+	return nil
+}
+
+// Spans returns the spans appended so far.
+func (a *Appender) Spans() []*zipkincore.Span {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return append([]*zipkincore.Span(nil), a.spans...)
+}
+
+// TraceIDs returns the trace IDs of the spans appended so far.
+func (a *Appender) TraceIDs() []int64 {
+	return TraceIDs(a.Spans())
+}
+
+// TraceIDs returns the trace IDs of spans.
+func TraceIDs(spans []*zipkincore.Span) []int64 {
+	ids := []int64{}
+	for _, span := range spans {
+		ids = append(ids, span.TraceID)
+	}
+	return ids
+}
@@ -1,41 +1,239 @@
 package loki
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/apache/thrift/lib/go/thrift"
 	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
+)
+
+// Want to be able to support a service doing 100 QPS with a 15s scrape
+// interval, with a hard ceiling on memory however big the traces get.
+var globalCollector = NewCollector(15*100,
+	WithMaxSpansPerTrace(DefaultMaxSpansPerTrace),
+	WithMaxBytes(DefaultMaxBytes),
+)
+
+const (
+	// DefaultSlowThreshold is how long a span must take for its trace to be
+	// kept in preference to others.
+	DefaultSlowThreshold = time.Second
+
+	// DefaultMaxSpansPerTrace and DefaultMaxBytes bound the memory the
+	// default Collector uses.
+	DefaultMaxSpansPerTrace = 1000
+	DefaultMaxBytes         = 64 << 20
+
+	// TruncatedKey tags the first span of a trace which had spans dropped by
+	// the Collector, with the number dropped.
+	TruncatedKey = "loki.truncated"
+
+	// DefaultConsumerTimeout is how long a scraper can go without scraping
+	// before the Collector stops holding spans for it.
+	DefaultConsumerTimeout = 10 * time.Minute
+
+	// DefaultMaxBatches is how many scraped batches are held for scrapers yet
+	// to acknowledge them, so a scraper which never does can't use unbounded
+	// memory.  At 15s scrapes, that outlasts DefaultConsumerTimeout.
+	DefaultMaxBatches = 64
 )
 
-// Want to be able to support a service doing 100 QPS with a 15s scrape interval
-var globalCollector = NewCollector(15 * 100)
+// Eviction policies, naming which traces were dropped when the Collector was
+// full.  Scraped traces some consumer has yet to acknowledge go first, then
+// unremarkable traces, oldest first; only when every trace held errored or was
+// slow are those dropped.
+const (
+	EvictUnacknowledged = "unacknowledged"
+	EvictOldest         = "oldest"
+	EvictError          = "error"
+	EvictSlow           = "slow"
+)
 
+// Collector holds recent traces until every scraper has acknowledged them.
+// It is bounded by the number of traces not yet scraped and of batches held
+// for scrapers, and optionally by the total number of spans held, their
+// estimated size in bytes, and the spans in any one trace.
 type Collector struct {
-	mtx      sync.Mutex
-	traceIDs map[int64]int // map from trace ID to index in traces
-	traces   []trace
-	next     int
-	length   int
+	mtx           sync.Mutex
+	traceIDs      map[model.TraceID]int // map from trace ID to index in traces
+	traces        []trace
+	next          int
+	length        int
+	slowThreshold int64 // microseconds
+	dropped       map[string]int
+
+	maxSpans         int
+	maxBytes         int
+	maxSpansPerTrace int
+	spans            int
+	bytes            int
+
+	// Batches of spans scraped, held until every consumer has acknowledged
+	// them.  spans and bytes count these too.
+	batches         []batch
+	cursor          uint64 // of the last batch
+	consumers       map[string]*consumer
+	consumerTimeout time.Duration
+	maxBatches      int
+}
+
+type batch struct {
+	cursor uint64
+	spans  []*zipkincore.Span
+	bytes  int
+}
+
+// consumer is a scraper reading the batches in order.
+type consumer struct {
+	acked    uint64
+	lastSeen time.Time
 }
 
 type trace struct {
-	traceID int64
-	spans   []*zipkincore.Span
+	traceID   model.TraceID
+	spans     []*zipkincore.Span
+	bytes     int
+	truncated int // spans dropped
+	errored   bool
+	slow      bool
+}
+
+// reset empties a slot for reuse, keeping its spans' backing array but
+// clearing it, so the spans evicted or drained from it can be freed.
+func (t *trace) reset() {
+	spans := t.spans[:cap(t.spans)]
+	for i := range spans {
+		spans[i] = nil
+	}
+	*t = trace{spans: spans[:0]}
+}
+
+// CollectorOption configures a Collector.
+type CollectorOption func(*Collector)
+
+// WithSlowThreshold sets how long a span must take for its trace to be kept
+// in preference to others.
+func WithSlowThreshold(d time.Duration) CollectorOption {
+	return func(c *Collector) {
+		c.slowThreshold = int64(d / time.Microsecond)
+	}
+}
+
+// WithMaxSpans bounds the total number of spans held.
+func WithMaxSpans(n int) CollectorOption {
+	return func(c *Collector) {
+		c.maxSpans = n
+	}
+}
+
+// WithMaxBytes bounds the estimated size of the spans held.
+func WithMaxBytes(n int) CollectorOption {
+	return func(c *Collector) {
+		c.maxBytes = n
+	}
+}
+
+// WithMaxSpansPerTrace bounds the number of spans held for any one trace;
+// further spans are dropped, and the trace marked as truncated.
+func WithMaxSpansPerTrace(n int) CollectorOption {
+	return func(c *Collector) {
+		c.maxSpansPerTrace = n
+	}
 }
 
-func NewCollector(capacity int) *Collector {
-	return &Collector{
-		traceIDs: make(map[int64]int, capacity),
-		traces:   make([]trace, capacity, capacity),
-		next:     0,
-		length:   0,
+// WithMaxBatches bounds the number of scraped batches held until every
+// scraper has acknowledged them; the oldest are dropped first.
+func WithMaxBatches(n int) CollectorOption {
+	return func(c *Collector) {
+		c.maxBatches = n
 	}
 }
 
+// WithConsumerTimeout sets how long a scraper can go without scraping before
+// the Collector stops holding spans for it.
+func WithConsumerTimeout(d time.Duration) CollectorOption {
+	return func(c *Collector) {
+		c.consumerTimeout = d
+	}
+}
+
+func NewCollector(capacity int, options ...CollectorOption) *Collector {
+	c := &Collector{
+		traceIDs:      make(map[model.TraceID]int, capacity),
+		traces:        make([]trace, capacity, capacity),
+		next:          0,
+		length:        0,
+		slowThreshold: int64(DefaultSlowThreshold / time.Microsecond),
+		dropped:       map[string]int{},
+
+		// Cursors start from the clock, so a restarted process doesn't
+		// mistake acknowledgements meant for its predecessor.
+		cursor:          uint64(time.Now().UnixNano()),
+		consumers:       map[string]*consumer{},
+		consumerTimeout: DefaultConsumerTimeout,
+		maxBatches:      DefaultMaxBatches,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// isError says whether a span is tagged as an error, as OpenTracing's
+// ext.Error does.
+func isError(span *zipkincore.Span) bool {
+	for _, annotation := range span.BinaryAnnotations {
+		if annotation.Key != "error" {
+			continue
+		}
+		switch annotation.AnnotationType {
+		case zipkincore.AnnotationType_BOOL:
+			return len(annotation.Value) > 0 && annotation.Value[0] != 0
+		case zipkincore.AnnotationType_STRING:
+			return string(annotation.Value) != "false"
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// Rough sizes of the thrift structs, for estimating the memory spans use.
+const (
+	spanOverhead       = 160
+	annotationOverhead = 64
+	endpointOverhead   = 64
+)
+
+func endpointSize(endpoint *zipkincore.Endpoint) int {
+	if endpoint == nil {
+		return 0
+	}
+	return endpointOverhead + len(endpoint.ServiceName) + len(endpoint.Ipv6)
+}
+
+// spanSize estimates the memory a span uses.  Endpoints are usually shared
+// between annotations, but are counted each time to be safe.
+func spanSize(span *zipkincore.Span) int {
+	size := spanOverhead + len(span.Name)
+	for _, annotation := range span.Annotations {
+		size += annotationOverhead + len(annotation.Value) + endpointSize(annotation.Host)
+	}
+	for _, annotation := range span.BinaryAnnotations {
+		size += annotationOverhead + len(annotation.Key) + len(annotation.Value) + endpointSize(annotation.Host)
+	}
+	return size
+}
+
 func (c *Collector) Collect(span *zipkincore.Span) error {
 	if span == nil {
 		return fmt.Errorf("cannot collect nil span")
@@ -44,49 +242,168 @@ func (c *Collector) Collect(span *zipkincore.Span) error {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	traceID := span.GetTraceID()
+	traceID := model.ZipkinTraceID(span)
+	size := spanSize(span)
 	idx, ok := c.traceIDs[traceID]
+	if ok && c.maxSpansPerTrace > 0 && len(c.traces[idx].spans) >= c.maxSpansPerTrace {
+		c.traces[idx].truncated++
+		return nil
+	}
+
+	// Make room for the span by dropping scraped batches, then evicting other
+	// traces.  If this trace alone fills the Collector, drop the span.
+	for c.overLimit(1, size) {
+		if c.dropBatch() {
+			continue
+		}
+		if !c.evict(&traceID) {
+			if ok {
+				c.traces[c.traceIDs[traceID]].truncated++
+			}
+			return nil
+		}
+	}
+
+	idx, ok = c.traceIDs[traceID]
 	if !ok {
+		// If we're full, make sure the oldest slot holds the trace to evict.
+		if c.length == cap(c.traces) {
+			c.evict(nil)
+		}
+		c.length++
+
 		// Pick a slot in c.spans for this trace
 		idx = c.next
 		c.next++
 		c.next %= cap(c.traces) // wrap
 
-		// If the slot it occupied, we'll need to clear the trace ID index,
-		// otherwise we'll need to number of traces.
-		if c.length == cap(c.traces) {
-			delete(c.traceIDs, c.traces[idx].traceID)
-		} else {
-			c.length++
-		}
-
 		// Initialise said slot.
 		c.traceIDs[traceID] = idx
-		c.traces[idx].traceID = traceID
-		c.traces[idx].spans = c.traces[idx].spans[:0]
+		c.traces[idx] = trace{
+			traceID: traceID,
+			spans:   c.traces[idx].spans[:0],
+		}
 	}
 
-	c.traces[idx].spans = append(c.traces[idx].spans, span)
+	t := &c.traces[idx]
+	t.spans = append(t.spans, span)
+	t.bytes += size
+	t.errored = t.errored || isError(span)
+	t.slow = t.slow || span.GetDuration() >= c.slowThreshold
+	c.spans++
+	c.bytes += size
 	return nil
 }
 
-func (*Collector) Close() error {
-	return nil
+func (c *Collector) overLimit(spans, bytes int) bool {
+	return (c.maxSpans > 0 && c.spans+spans > c.maxSpans) ||
+		(c.maxBytes > 0 && c.bytes+bytes > c.maxBytes)
+}
+
+// evict drops a trace other than keep: the oldest trace which neither errored
+// nor was slow, or failing that the oldest.  Older traces are moved up a slot,
+// keeping them in order and leaving the oldest slot free.  It returns false
+// if there was no trace to drop.
+func (c *Collector) evict(keep *model.TraceID) bool {
+	size := cap(c.traces)
+	oldest := (c.next - c.length + size) % size
+	candidate := func(t *trace) bool {
+		return keep == nil || t.traceID != *keep
+	}
+	victim := -1
+	for i := 0; i < c.length; i++ {
+		t := &c.traces[(oldest+i)%size]
+		if !candidate(t) {
+			continue
+		}
+		if victim < 0 {
+			victim = i
+		}
+		if !t.errored && !t.slow {
+			victim = i
+			break
+		}
+	}
+	if victim < 0 {
+		return false
+	}
+	for i := victim; i > 0; i-- {
+		from, to := (oldest+i-1)%size, (oldest+i)%size
+		c.traces[from], c.traces[to] = c.traces[to], c.traces[from]
+		c.traceIDs[c.traces[to].traceID] = to
+	}
+
+	t := &c.traces[oldest]
+	switch {
+	case t.errored:
+		c.dropped[EvictError]++
+	case t.slow:
+		c.dropped[EvictSlow]++
+	default:
+		c.dropped[EvictOldest]++
+	}
+	delete(c.traceIDs, t.traceID)
+	c.spans -= len(t.spans)
+	c.bytes -= t.bytes
+	c.length--
+	t.reset()
+	return true
 }
 
-func (c *Collector) gather() []*zipkincore.Span {
+// DroppedTraces returns how many traces each eviction policy has dropped.
+func (c *Collector) DroppedTraces() map[string]int {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
+	result := make(map[string]int, len(c.dropped))
+	for policy, count := range c.dropped {
+		result[policy] = count
+	}
+	return result
+}
+
+func (*Collector) Close() error {
+	return nil
+}
+
+// truncationMarker tags a span with the number of spans dropped from its
+// trace, on the span's own host so it is attributed to the right service.
+func truncationMarker(span *zipkincore.Span, dropped int) *zipkincore.BinaryAnnotation {
+	var host *zipkincore.Endpoint
+	for _, annotation := range span.Annotations {
+		if host = annotation.Host; host != nil {
+			break
+		}
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(dropped))
+	return &zipkincore.BinaryAnnotation{
+		Key:            TruncatedKey,
+		Value:          value,
+		AnnotationType: zipkincore.AnnotationType_I64,
+		Host:           host,
+	}
+}
 
-	spans := make([]*zipkincore.Span, 0, c.length)
+// drain empties the buffer into a new batch.  c.mtx must be held.
+func (c *Collector) drain() {
+	if c.length == 0 {
+		return
+	}
+	b := batch{}
 	i, count := c.next-c.length, 0
 	if i < 0 {
 		i = cap(c.traces) + i
 	}
 	for count < c.length {
 		i %= cap(c.traces)
-		spans = append(spans, c.traces[i].spans...)
-		delete(c.traceIDs, c.traces[i].traceID)
+		t := &c.traces[i]
+		if t.truncated > 0 && len(t.spans) > 0 {
+			t.spans[0].BinaryAnnotations = append(t.spans[0].BinaryAnnotations, truncationMarker(t.spans[0], t.truncated))
+		}
+		b.spans = append(b.spans, t.spans...)
+		b.bytes += t.bytes
+		delete(c.traceIDs, t.traceID)
+		t.reset()
 		i++
 		count++
 	}
@@ -94,11 +411,129 @@ func (c *Collector) gather() []*zipkincore.Span {
 	if len(c.traceIDs) != 0 {
 		panic("didn't clear all trace ids")
 	}
-	return spans
+	c.cursor++
+	b.cursor = c.cursor
+	c.batches = append(c.batches, b)
+	for c.maxBatches > 0 && len(c.batches) > c.maxBatches {
+		c.dropBatch()
+	}
+}
+
+// freeBatches frees the oldest n batches.
+func (c *Collector) freeBatches(n int) {
+	for _, b := range c.batches[:n] {
+		c.spans -= len(b.spans)
+		c.bytes -= b.bytes
+	}
+	remaining := copy(c.batches, c.batches[n:])
+	for i := remaining; i < len(c.batches); i++ {
+		c.batches[i] = batch{}
+	}
+	c.batches = c.batches[:remaining]
+}
+
+// dropBatch frees the oldest batch, although some consumer has yet to
+// acknowledge it, to make room.  It returns false if there are no batches.
+func (c *Collector) dropBatch() bool {
+	if len(c.batches) == 0 {
+		return false
+	}
+	traceIDs := map[model.TraceID]struct{}{}
+	for _, span := range c.batches[0].spans {
+		traceIDs[model.ZipkinTraceID(span)] = struct{}{}
+	}
+	c.dropped[EvictUnacknowledged] += len(traceIDs)
+	c.freeBatches(1)
+	return true
+}
+
+// The scraping protocol.  Each scrape takes the spans collected since the
+// last into a new batch.  A scraper, identified by ScraperIDHeader, is sent
+// every batch it has yet to acknowledge, along with the cursor of the last
+// in CursorHeader.  It acknowledges them by passing that cursor in AckParam
+// on its next scrape.  Batches are held until every scraper seen in the last
+// consumer timeout has acknowledged them, so several Loki replicas can each
+// receive every span, and a failed scrape loses nothing.
+//
+// A scrape without AckParam, from an older scraper, is sent every batch it
+// has yet to see, with no acknowledgement needed.
+const (
+	ScraperIDHeader = "X-Loki-Scraper-ID"
+	CursorHeader    = "X-Loki-Cursor"
+	AckParam        = "ack"
+)
+
+// scrape returns the spans the consumer id has yet to acknowledge, once ack
+// is taken into account, and the cursor to acknowledge them with.  If
+// autoAck, they are taken as acknowledged straight away.
+func (c *Collector) scrape(id string, ack uint64, autoAck bool) (uint64, []*zipkincore.Span) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.drain()
+	con, ok := c.consumers[id]
+	if !ok {
+		// New consumers start from the oldest batch still held.
+		con = &consumer{acked: c.cursor}
+		if len(c.batches) > 0 {
+			con.acked = c.batches[0].cursor - 1
+		}
+		c.consumers[id] = con
+	}
+	if ack > con.acked && ack <= c.cursor {
+		con.acked = ack
+	}
+	con.lastSeen = now()
+
+	spans := []*zipkincore.Span{}
+	for _, b := range c.batches {
+		if b.cursor > con.acked {
+			spans = append(spans, b.spans...)
+		}
+	}
+	if autoAck {
+		con.acked = c.cursor
+	}
+	cursor := c.cursor
+	c.release(con.lastSeen)
+	return cursor, spans
+}
+
+// release forgets consumers which have stopped scraping, and frees the
+// batches every remaining consumer has acknowledged.
+func (c *Collector) release(t time.Time) {
+	acked := c.cursor
+	for id, con := range c.consumers {
+		if c.consumerTimeout > 0 && t.Sub(con.lastSeen) > c.consumerTimeout {
+			delete(c.consumers, id)
+			continue
+		}
+		if con.acked < acked {
+			acked = con.acked
+		}
+	}
+	n := 0
+	for n < len(c.batches) && c.batches[n].cursor <= acked {
+		n++
+	}
+	c.freeBatches(n)
 }
 
 func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	spans := c.gather()
+	var ack uint64
+	ackParam, acknowledging := r.URL.Query()[AckParam]
+	if acknowledging {
+		var err error
+		if ack, err = strconv.ParseUint(ackParam[0], 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s: %v", AckParam, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	cursor, spans := c.scrape(r.Header.Get(ScraperIDHeader), ack, !acknowledging)
+	if acknowledging {
+		w.Header().Set(CursorHeader, strconv.FormatUint(cursor, 10))
+	}
 	if err := WriteSpans(spans, w); err != nil {
 		log.Printf("error writing spans: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
@@ -35,11 +38,11 @@ func TestCollectorSpans(t *testing.T) {
 		}
 	}
 
-	if have := collector.gather(); !reflect.DeepEqual(want, have) {
+	if have := take(collector); !reflect.DeepEqual(want, have) {
 		t.Fatalf("%s", Diff(want, have))
 	}
 
-	if want, have := []*zipkincore.Span{}, collector.gather(); !reflect.DeepEqual(want, have) {
+	if want, have := []*zipkincore.Span{}, take(collector); !reflect.DeepEqual(want, have) {
 		t.Fatalf("%s", Diff(want, have))
 	}
 
@@ -55,11 +58,328 @@ func TestCollectorSpans(t *testing.T) {
 		}
 	}
 
-	if have := collector.gather(); !reflect.DeepEqual(want, have) {
+	if have := take(collector); !reflect.DeepEqual(want, have) {
 		t.Fatalf("%s", Diff(want, have))
 	}
 
-	if want, have := []*zipkincore.Span{}, collector.gather(); !reflect.DeepEqual(want, have) {
+	if want, have := []*zipkincore.Span{}, take(collector); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+}
+
+func TestCollector128BitTraceIDs(t *testing.T) {
+	collector := NewCollector(5)
+
+	// Traces differing only in their high bits are kept apart.
+	spans := []*zipkincore.Span{}
+	for _, high := range []int64{1, 2, 1} {
+		high := high
+		span := zipkincore.NewSpan()
+		span.TraceID = 1
+		span.TraceIDHigh = &high
+		spans = append(spans, span)
+		if err := collector.Collect(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []*zipkincore.Span{spans[0], spans[2], spans[1]}
+	if have := take(collector); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+}
+
+func TestCollectorEviction(t *testing.T) {
+	collector := NewCollector(3, WithSlowThreshold(time.Second))
+
+	spans := map[int64]*zipkincore.Span{}
+	for _, tc := range []struct {
+		traceID  int64
+		errored  bool
+		duration int64
+	}{
+		{1, true, 10},
+		{2, false, 10},
+		{3, false, 2000000},
+		{4, false, 10}, // drops 2
+		{5, true, 10},  // drops 4
+		{6, false, 10}, // all the rest errored or were slow, so drops 1
+	} {
+		span := zipkincore.NewSpan()
+		span.TraceID = tc.traceID
+		duration := tc.duration
+		span.Duration = &duration
+		if tc.errored {
+			span.BinaryAnnotations = []*zipkincore.BinaryAnnotation{
+				{Key: "error", Value: []byte{1}, AnnotationType: zipkincore.AnnotationType_BOOL},
+			}
+		}
+		spans[tc.traceID] = span
+		if err := collector.Collect(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []*zipkincore.Span{spans[3], spans[5], spans[6]}
+	if have := take(collector); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+	if want, have := map[string]int{EvictOldest: 2, EvictError: 1}, collector.DroppedTraces(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+}
+
+func TestCollectorReleasesSpans(t *testing.T) {
+	collector := NewCollector(2)
+	for i := int64(1); i <= 3; i++ {
+		span := zipkincore.NewSpan()
+		span.TraceID = i
+		if err := collector.Collect(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+	take(collector)
+
+	// Neither the evicted trace nor the drained ones are reachable.
+	for i, slot := range collector.traces {
+		for _, span := range slot.spans[:cap(slot.spans)] {
+			if span != nil {
+				t.Fatalf("slot %d still holds trace %d", i, span.TraceID)
+			}
+		}
+	}
+}
+
+func TestCollectorLimits(t *testing.T) {
+	host := zipkincore.NewEndpoint()
+	host.ServiceName = "web"
+	newSpan := func(traceID, id int64) *zipkincore.Span {
+		span := zipkincore.NewSpan()
+		span.TraceID = traceID
+		span.ID = id
+		span.Annotations = []*zipkincore.Annotation{{Value: zipkincore.SERVER_RECV, Host: host}}
+		return span
+	}
+
+	// Runaway traces are truncated, and marked as such.
+	collector := NewCollector(10, WithMaxSpansPerTrace(2), WithMaxSpans(3))
+	var spans []*zipkincore.Span
+	for i := int64(0); i < 5; i++ {
+		span := newSpan(1, i)
+		spans = append(spans, span)
+		if err := collector.Collect(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+	have := take(collector)
+	if want := spans[:2]; !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+	marker := truncationMarker(spans[0], 3)
+	if want := []*zipkincore.BinaryAnnotation{marker}; !reflect.DeepEqual(want, have[0].BinaryAnnotations) {
+		t.Fatalf("%s", Diff(want, have[0].BinaryAnnotations))
+	}
+	if marker.Host != host {
+		t.Fatalf("expected marker on the span's host")
+	}
+
+	// Other traces are evicted to stay under the span limit.
+	spans = []*zipkincore.Span{newSpan(2, 1), newSpan(2, 2), newSpan(3, 1), newSpan(3, 2)}
+	for _, span := range spans {
+		if err := collector.Collect(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, have := spans[2:], take(collector); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+	if want, have := map[string]int{EvictOldest: 1}, collector.DroppedTraces(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+
+	// A trace filling the whole Collector is truncated.
+	collector = NewCollector(10, WithMaxBytes(spanSize(newSpan(4, 1))))
+	for i := int64(1); i <= 2; i++ {
+		if err := collector.Collect(newSpan(4, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if have := take(collector); len(have) != 1 || len(have[0].BinaryAnnotations) != 1 {
+		t.Fatalf("expected one truncated span, have %s", spew.Sdump(have))
+	}
+}
+
+// take scrapes the Collector as a scraper which doesn't acknowledge batches
+// would, taking everything it holds.
+func take(c *Collector) []*zipkincore.Span {
+	_, spans := c.scrape("", 0, true)
+	return spans
+}
+
+type testScraper struct {
+	t      *testing.T
+	url    string
+	id     string
+	cursor string
+}
+
+// scrape scrapes the Collector, acknowledging the last scrape if ack.
+func (s *testScraper) scrape(ack bool) []*zipkincore.Span {
+	query := "?ack=0"
+	if ack && s.cursor != "" {
+		query = "?ack=" + s.cursor
+	}
+	req, err := http.NewRequest("GET", s.url+query, nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req.Header.Set(ScraperIDHeader, s.id)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	spans, err := ReadSpans(resp.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.cursor = resp.Header.Get(CursorHeader)
+	return spans
+}
+
+func collectTestSpan(t *testing.T, collector *Collector, traceID int64) *zipkincore.Span {
+	span := zipkincore.NewSpan()
+	span.TraceID = traceID
+	span.Annotations = []*zipkincore.Annotation{}
+	span.BinaryAnnotations = []*zipkincore.BinaryAnnotation{}
+	if err := collector.Collect(span); err != nil {
+		t.Fatal(err)
+	}
+	return span
+}
+
+func TestCollectorAcknowledgements(t *testing.T) {
+	collector := NewCollector(10)
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	scraper := &testScraper{t: t, url: server.URL, id: "loki"}
+
+	first := collectTestSpan(t, collector, 1)
+	if want, have := []*zipkincore.Span{first}, scraper.scrape(true); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+
+	// Until spans are acknowledged, they are sent again.
+	second := collectTestSpan(t, collector, 2)
+	if want, have := []*zipkincore.Span{first, second}, scraper.scrape(false); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+	third := collectTestSpan(t, collector, 3)
+	if want, have := []*zipkincore.Span{third}, scraper.scrape(true); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+
+	// Scrapes without acknowledgements take everything they've not seen;
+	// new consumers start from the oldest spans still held.
+	fourth := collectTestSpan(t, collector, 4)
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	have, err := ReadSpans(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*zipkincore.Span{third, fourth}; !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+	if have := scraper.scrape(true); !reflect.DeepEqual([]*zipkincore.Span{fourth}, have) {
+		t.Fatalf("%s", Diff([]*zipkincore.Span{fourth}, have))
+	}
+}
+
+func TestCollectorConsumers(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := start
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	collector := NewCollector(10, WithConsumerTimeout(time.Minute))
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	a := &testScraper{t: t, url: server.URL, id: "a"}
+	b := &testScraper{t: t, url: server.URL, id: "b"}
+	a.scrape(true)
+	b.scrape(true)
+
+	// Each consumer gets every span, which is held until both acknowledge it.
+	first := collectTestSpan(t, collector, 1)
+	second := collectTestSpan(t, collector, 2)
+	if want, have := []*zipkincore.Span{first, second}, a.scrape(true); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+	if want, have := []*zipkincore.Span{first, second}, b.scrape(true); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+	a.scrape(true)
+	if want, have := 2, collector.spans; want != have {
+		t.Fatalf("expected %d spans held, have %d", want, have)
+	}
+	b.scrape(true)
+	if want, have := 0, collector.spans; want != have {
+		t.Fatalf("expected %d spans held, have %d", want, have)
+	}
+
+	// Consumers which stop scraping are forgotten.
+	third := collectTestSpan(t, collector, 3)
+	if want, have := []*zipkincore.Span{third}, a.scrape(true); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+	clock = start.Add(2 * time.Minute)
+	a.scrape(true)
+	if want, have := 0, collector.spans; want != have {
+		t.Fatalf("expected %d spans held, have %d", want, have)
+	}
+
+	// Under memory pressure, spans a consumer is yet to acknowledge are
+	// dropped first.
+	collector = NewCollector(10, WithMaxSpans(1))
+	server = httptest.NewServer(collector)
+	defer server.Close()
+	a = &testScraper{t: t, url: server.URL, id: "a"}
+	collectTestSpan(t, collector, 1)
+	a.scrape(true)
+	fourth := collectTestSpan(t, collector, 4)
+	if want, have := []*zipkincore.Span{fourth}, a.scrape(false); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+	if want, have := map[string]int{EvictUnacknowledged: 1}, collector.DroppedTraces(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+}
+
+func TestCollectorMaxBatches(t *testing.T) {
+	collector := NewCollector(10, WithMaxBatches(2))
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	a := &testScraper{t: t, url: server.URL, id: "a"}
+
+	// A scraper which never acknowledges anything is sent the most recent
+	// batches only.
+	first := collectTestSpan(t, collector, 1)
+	if want, have := []*zipkincore.Span{first}, a.scrape(false); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+	second := collectTestSpan(t, collector, 2)
+	if want, have := []*zipkincore.Span{first, second}, a.scrape(false); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+	third := collectTestSpan(t, collector, 3)
+	if want, have := []*zipkincore.Span{second, third}, a.scrape(false); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", Diff(want, have))
+	}
+	if want, have := map[string]int{EvictUnacknowledged: 1}, collector.DroppedTraces(); !reflect.DeepEqual(want, have) {
 		t.Fatalf("%s", Diff(want, have))
 	}
 }
@@ -81,11 +401,11 @@ func TestCollectorFuzzSpans(t *testing.T) {
 			}
 		}
 
-		if have := collector.gather(); !reflect.DeepEqual(want, have) {
+		if have := take(collector); !reflect.DeepEqual(want, have) {
 			t.Fatalf("%s", Diff(want, have))
 		}
 
-		if want, have := []*zipkincore.Span{}, collector.gather(); !reflect.DeepEqual(want, have) {
+		if want, have := []*zipkincore.Span{}, take(collector); !reflect.DeepEqual(want, have) {
 			t.Fatalf("%s", Diff(want, have))
 		}
 	}
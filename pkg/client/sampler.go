@@ -0,0 +1,75 @@
+package loki
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Sampler decides whether to record a new trace, given the low 64 bits of its
+// ID.  Only the service starting a trace asks; the decision is propagated with
+// the trace context, so every service in a request makes the same call.
+type Sampler func(traceID uint64) bool
+
+// AlwaysSample records every trace.
+func AlwaysSample() Sampler {
+	return func(uint64) bool { return true }
+}
+
+// NeverSample records no traces, unless an upstream service sampled them.
+func NeverSample() Sampler {
+	return func(uint64) bool { return false }
+}
+
+// ProbabilisticSampler records the given fraction of traces.  Trace IDs are
+// random, so the decision is made by comparing the ID to a threshold: any
+// service sampling at the same rate agrees, and all traces sampled at one
+// rate are also sampled at any higher rate.  A rate which isn't a number
+// samples nothing.
+//
+// The tracer's IDs are random 63-bit numbers, so only the low 63 bits of an ID
+// are compared; IDs from other tracers with all 64 bits set agree.
+func ProbabilisticSampler(rate float64) Sampler {
+	if !(rate > 0) {
+		return NeverSample()
+	}
+
+	// Converting a float64 of 2^63 or more to the boundary overflows.
+	bound := rate * (1 << 63)
+	if bound >= 1<<63 {
+		return AlwaysSample()
+	}
+	boundary := uint64(bound)
+	return func(traceID uint64) bool {
+		return traceID&(1<<63-1) < boundary
+	}
+}
+
+// now is replaced in tests.
+var now = time.Now
+
+// RateLimitingSampler records at most perSecond traces a second, using a token
+// bucket which holds up to a second's worth of traces.
+func RateLimitingSampler(perSecond float64) Sampler {
+	if perSecond <= 0 {
+		return NeverSample()
+	}
+	var (
+		mtx    sync.Mutex
+		burst  = math.Max(perSecond, 1)
+		tokens = burst
+		last   = now()
+	)
+	return func(uint64) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		t := now()
+		tokens = math.Min(burst, tokens+t.Sub(last).Seconds()*perSecond)
+		last = t
+		if tokens < 1 {
+			return false
+		}
+		tokens--
+		return true
+	}
+}
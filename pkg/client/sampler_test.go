@@ -0,0 +1,107 @@
+package loki
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/openzipkin/zipkin-go-opentracing"
+)
+
+func TestProbabilisticSampler(t *testing.T) {
+	low, high := ProbabilisticSampler(0.1), ProbabilisticSampler(0.5)
+	for i := 0; i < 10000; i++ {
+		// IDs as the tracer makes them.
+		id := uint64(rand.Int63())
+		if low(id) && !high(id) {
+			t.Fatalf("%x sampled at 10%% but not 50%%", id)
+		}
+		if low(id) != ProbabilisticSampler(0.1)(id) {
+			t.Fatalf("%x: inconsistent decision", id)
+		}
+	}
+
+	if ProbabilisticSampler(0)(0) || !ProbabilisticSampler(1)(1<<64-1) {
+		t.Fatal("expected rates of 0 and 1 to never and always sample")
+	}
+	for _, rate := range []float64{-1, math.NaN(), math.Inf(-1)} {
+		if ProbabilisticSampler(rate)(0) {
+			t.Fatalf("expected a rate of %v to never sample", rate)
+		}
+	}
+	if !ProbabilisticSampler(math.Inf(1))(1<<64 - 1) {
+		t.Fatal("expected an infinite rate to always sample")
+	}
+	if below := math.Nextafter(1, 0); !ProbabilisticSampler(below)(1<<63-1<<11) || ProbabilisticSampler(below)(1<<63-1) {
+		t.Fatalf("expected a rate of %v to sample all but the highest IDs", below)
+	}
+}
+
+func TestTracerProbabilisticSampling(t *testing.T) {
+	for _, rate := range []float64{0.1, 0.5, 0.9} {
+		tracer, err := NewTracer(WithSampler(ProbabilisticSampler(rate)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sampled := 0
+		// The spans aren't finished, so nothing is collected.
+		for i := 0; i < 10000; i++ {
+			if tracer.StartSpan("get").Context().(zipkintracer.SpanContext).Sampled {
+				sampled++
+			}
+		}
+		if want := int(rate * 10000); sampled < want-500 || sampled > want+500 {
+			t.Fatalf("sampled %d of 10000 traces at %v", sampled, rate)
+		}
+	}
+}
+
+func TestRateLimitingSampler(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := start
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	sampler := RateLimitingSampler(2)
+	count := func() int {
+		n := 0
+		for i := 0; i < 10; i++ {
+			if sampler(uint64(i)) {
+				n++
+			}
+		}
+		return n
+	}
+
+	if want, have := 2, count(); want != have {
+		t.Fatalf("want %d, have %d", want, have)
+	}
+	clock = start.Add(500 * time.Millisecond)
+	if want, have := 1, count(); want != have {
+		t.Fatalf("want %d, have %d", want, have)
+	}
+	clock = start.Add(time.Minute)
+	if want, have := 2, count(); want != have {
+		t.Fatalf("want %d, have %d", want, have)
+	}
+}
+
+func TestTracerSampling(t *testing.T) {
+	for _, tc := range []struct {
+		sampler Sampler
+		want    int
+	}{
+		{NeverSample(), 0},
+		{AlwaysSample(), 1},
+	} {
+		tracer, err := NewTracer(WithSampler(tc.sampler))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracer.StartSpan("get").Finish()
+		if have := len(take(globalCollector)); tc.want != have {
+			t.Fatalf("want %d spans, have %d", tc.want, have)
+		}
+	}
+}
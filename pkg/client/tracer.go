@@ -8,7 +8,29 @@ import (
 	"github.com/openzipkin/zipkin-go-opentracing"
 )
 
-func NewTracer() (opentracing.Tracer, error) {
+type tracerOptions struct {
+	sampler Sampler
+}
+
+// TracerOption configures the tracer made by NewTracer.
+type TracerOption func(*tracerOptions)
+
+// WithSampler sets the sampler deciding which traces are recorded.  By
+// default every trace is.
+func WithSampler(sampler Sampler) TracerOption {
+	return func(opts *tracerOptions) {
+		opts.sampler = sampler
+	}
+}
+
+func NewTracer(options ...TracerOption) (opentracing.Tracer, error) {
+	opts := tracerOptions{
+		sampler: AlwaysSample(),
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+
 	// create recorder.
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -16,8 +38,12 @@ func NewTracer() (opentracing.Tracer, error) {
 	}
 	recorder := zipkintracer.NewRecorder(globalCollector, false, hostname, "")
 
-	// create tracer.
-	tracer, err := zipkintracer.NewTracer(recorder)
+	// create tracer.  Unsampled spans are trimmed, so cost next to nothing.
+	tracer, err := zipkintracer.NewTracer(recorder,
+		zipkintracer.TraceID128Bit(true),
+		zipkintracer.WithSampler(zipkintracer.Sampler(opts.sampler)),
+		zipkintracer.TrimUnsampledSpans(true),
+	)
 	if err != nil {
 		fmt.Printf("unable to create Zipkin tracer: %+v", err)
 		os.Exit(-1)
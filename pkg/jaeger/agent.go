@@ -0,0 +1,109 @@
+package jaeger
+
+import (
+	"flag"
+	"net"
+	"sync"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
+)
+
+// Jaeger clients keep their batches within a UDP datagram.
+const maxPacketSize = 65000
+
+// Config configures the Jaeger agent.
+type Config struct {
+	Addr string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Addr, "jaeger.agent-addr", "", "UDP address to receive Jaeger compact thrift batches on, such as :6831; empty disables it.")
+}
+
+// Appender stores the spans received.
+type Appender interface {
+	Append(*zipkincore.Span) error
+}
+
+// Agent receives the batches Jaeger clients emit over UDP, as Jaeger's own
+// agent would, and appends their spans.
+type Agent struct {
+	appender Appender
+	conn     *net.UDPConn
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewAgent starts listening.
+func NewAgent(cfg Config, appender Appender) (*Agent, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	a := &Agent{
+		appender: appender,
+		conn:     conn,
+		quit:     make(chan struct{}),
+	}
+	a.wg.Add(1)
+	go a.loop()
+	return a, nil
+}
+
+// Addr returns the address the agent is listening on.
+func (a *Agent) Addr() net.Addr {
+	return a.conn.LocalAddr()
+}
+
+func (a *Agent) loop() {
+	defer a.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := a.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-a.quit:
+				return
+			default:
+			}
+			log.Errorf("Error reading Jaeger batch: %v", err)
+			continue
+		}
+		a.handle(buf[:n])
+	}
+}
+
+// handle appends the spans in a packet.  Packets which can't be decoded are
+// logged and dropped; there's no one to reply to.
+func (a *Agent) handle(packet []byte) {
+	transport := thrift.NewTMemoryBufferLen(len(packet))
+	transport.Write(packet)
+	batch, err := ReadEmitBatch(thrift.NewTCompactProtocol(transport))
+	if err != nil {
+		log.Errorf("Error decoding Jaeger batch: %v", err)
+		return
+	}
+	for i := range batch.Spans {
+		if err := a.appender.Append(model.ToZipkin(ToSpan(&batch.Process, &batch.Spans[i]))); err != nil {
+			log.Errorf("Error appending span from %s: %v", batch.Process.ServiceName, err)
+			return
+		}
+	}
+}
+
+// Stop stops listening.
+func (a *Agent) Stop() error {
+	close(a.quit)
+	err := a.conn.Close()
+	a.wg.Wait()
+	return err
+}
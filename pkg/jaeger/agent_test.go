@@ -0,0 +1,217 @@
+package jaeger
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+
+	"github.com/weaveworks-experiments/loki/pkg/appendertest"
+)
+
+// The encoding half of jaeger.thrift, as a client would write it.
+
+func writeTags(p thrift.TProtocol, id int16, tags []Tag) {
+	p.WriteFieldBegin("", thrift.LIST, id)
+	p.WriteListBegin(thrift.STRUCT, len(tags))
+	for _, tag := range tags {
+		p.WriteStructBegin("Tag")
+		p.WriteFieldBegin("key", thrift.STRING, 1)
+		p.WriteString(tag.Key)
+		p.WriteFieldBegin("vType", thrift.I32, 2)
+		p.WriteI32(tag.VType)
+		switch tag.VType {
+		case tagString:
+			p.WriteFieldBegin("vStr", thrift.STRING, 3)
+			p.WriteString(tag.VStr)
+		case tagBool:
+			p.WriteFieldBegin("vBool", thrift.BOOL, 5)
+			p.WriteBool(tag.VBool)
+		case tagLong:
+			p.WriteFieldBegin("vLong", thrift.I64, 6)
+			p.WriteI64(tag.VLong)
+		}
+		p.WriteFieldStop()
+		p.WriteStructEnd()
+	}
+	p.WriteListEnd()
+}
+
+func writeSpan(p thrift.TProtocol, span Span) {
+	p.WriteStructBegin("Span")
+	for _, field := range []struct {
+		id    int16
+		value int64
+	}{
+		{1, span.TraceIDLow}, {2, span.TraceIDHigh}, {3, span.SpanID}, {4, span.ParentSpanID},
+	} {
+		p.WriteFieldBegin("", thrift.I64, field.id)
+		p.WriteI64(field.value)
+	}
+	p.WriteFieldBegin("operationName", thrift.STRING, 5)
+	p.WriteString(span.OperationName)
+	p.WriteFieldBegin("references", thrift.LIST, 6)
+	p.WriteListBegin(thrift.STRUCT, len(span.References))
+	for _, ref := range span.References {
+		p.WriteStructBegin("SpanRef")
+		p.WriteFieldBegin("refType", thrift.I32, 1)
+		p.WriteI32(ref.RefType)
+		p.WriteFieldBegin("traceIdLow", thrift.I64, 2)
+		p.WriteI64(ref.TraceIDLow)
+		p.WriteFieldBegin("traceIdHigh", thrift.I64, 3)
+		p.WriteI64(ref.TraceIDHigh)
+		p.WriteFieldBegin("spanId", thrift.I64, 4)
+		p.WriteI64(ref.SpanID)
+		p.WriteFieldStop()
+		p.WriteStructEnd()
+	}
+	p.WriteListEnd()
+	p.WriteFieldBegin("flags", thrift.I32, 7)
+	p.WriteI32(span.Flags)
+	p.WriteFieldBegin("startTime", thrift.I64, 8)
+	p.WriteI64(span.StartTime)
+	p.WriteFieldBegin("duration", thrift.I64, 9)
+	p.WriteI64(span.Duration)
+	writeTags(p, 10, span.Tags)
+	p.WriteFieldBegin("logs", thrift.LIST, 11)
+	p.WriteListBegin(thrift.STRUCT, len(span.Logs))
+	for _, log := range span.Logs {
+		p.WriteStructBegin("Log")
+		p.WriteFieldBegin("timestamp", thrift.I64, 1)
+		p.WriteI64(log.Timestamp)
+		writeTags(p, 2, log.Fields)
+		p.WriteFieldStop()
+		p.WriteStructEnd()
+	}
+	p.WriteListEnd()
+	// A field from the future, which should be skipped.
+	p.WriteFieldBegin("unknown", thrift.STRING, 99)
+	p.WriteString("?")
+	p.WriteFieldStop()
+	p.WriteStructEnd()
+}
+
+func encodeEmitBatch(batch Batch) []byte {
+	transport := thrift.NewTMemoryBuffer()
+	p := thrift.NewTCompactProtocol(transport)
+	p.WriteMessageBegin("emitBatch", thrift.ONEWAY, 1)
+	p.WriteStructBegin("emitBatch_args")
+	p.WriteFieldBegin("batch", thrift.STRUCT, 1)
+	p.WriteStructBegin("Batch")
+	p.WriteFieldBegin("process", thrift.STRUCT, 1)
+	p.WriteStructBegin("Process")
+	p.WriteFieldBegin("serviceName", thrift.STRING, 1)
+	p.WriteString(batch.Process.ServiceName)
+	writeTags(p, 2, batch.Process.Tags)
+	p.WriteFieldStop()
+	p.WriteStructEnd()
+	p.WriteFieldBegin("spans", thrift.LIST, 2)
+	p.WriteListBegin(thrift.STRUCT, len(batch.Spans))
+	for _, span := range batch.Spans {
+		writeSpan(p, span)
+	}
+	p.WriteListEnd()
+	p.WriteFieldStop()
+	p.WriteStructEnd()
+	p.WriteFieldStop()
+	p.WriteStructEnd()
+	p.WriteMessageEnd()
+	p.Flush()
+	return transport.Bytes()
+}
+
+func TestAgent(t *testing.T) {
+	appender := &appendertest.Appender{}
+	agent, err := NewAgent(Config{Addr: "127.0.0.1:0"}, appender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Stop()
+
+	batch := Batch{
+		Process: Process{
+			ServiceName: "frontend",
+			Tags: []Tag{
+				{Key: "ip", VType: tagString, VStr: "10.0.0.1"},
+				{Key: "hostname", VType: tagString, VStr: "frontend-1"},
+			},
+		},
+		Spans: []Span{{
+			TraceIDLow:    1,
+			TraceIDHigh:   2,
+			SpanID:        4,
+			OperationName: "get",
+			References: []SpanRef{
+				{RefType: refFollowsFrom, TraceIDLow: 1, TraceIDHigh: 2, SpanID: 5},
+				{RefType: refChildOf, TraceIDLow: 1, TraceIDHigh: 2, SpanID: 3},
+				{RefType: refFollowsFrom, TraceIDLow: 9, SpanID: 8},
+			},
+			Flags:     debugFlag,
+			StartTime: 1000,
+			Duration:  10,
+			Tags: []Tag{
+				{Key: "span.kind", VType: tagString, VStr: "client"},
+				{Key: "peer.service", VType: tagString, VStr: "backend"},
+				{Key: "error", VType: tagBool, VBool: true},
+			},
+			Logs: []Log{
+				{Timestamp: 1005, Fields: []Tag{{Key: "event", VType: tagString, VStr: "retry"}}},
+			},
+		}},
+	}
+
+	// The batch has to be sent as a single datagram.
+	conn, err := net.Dial("udp", agent.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(encodeEmitBatch(batch)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(appender.Spans()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no spans received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	local := zipkincore.NewEndpoint()
+	local.ServiceName = "frontend"
+	local.Ipv4 = 10<<24 | 1
+	remote := zipkincore.NewEndpoint()
+	remote.ServiceName = "backend"
+	traceIDHigh, parentID, timestamp, duration := int64(2), int64(3), int64(1000), int64(10)
+	want := &zipkincore.Span{
+		TraceID:     1,
+		TraceIDHigh: &traceIDHigh,
+		ID:          4,
+		ParentID:    &parentID,
+		Name:        "get",
+		Debug:       true,
+		Timestamp:   &timestamp,
+		Duration:    &duration,
+		Annotations: []*zipkincore.Annotation{
+			{Timestamp: 1000, Value: zipkincore.CLIENT_SEND, Host: local},
+			{Timestamp: 1010, Value: zipkincore.CLIENT_RECV, Host: local},
+			{Timestamp: 1005, Value: "retry", Host: local},
+		},
+		BinaryAnnotations: []*zipkincore.BinaryAnnotation{
+			{Key: "error", Value: []byte{1}, AnnotationType: zipkincore.AnnotationType_BOOL, Host: local},
+			{Key: "loki.link", Value: []byte("00000000000000020000000000000001:0000000000000005"), AnnotationType: zipkincore.AnnotationType_STRING, Host: local},
+			{Key: "loki.link", Value: []byte("0000000000000009:0000000000000008"), AnnotationType: zipkincore.AnnotationType_STRING, Host: local},
+			{Key: zipkincore.SERVER_ADDR, Value: []byte{1}, AnnotationType: zipkincore.AnnotationType_BOOL, Host: remote},
+		},
+	}
+	if have := appender.Spans(); len(have) != 1 || !reflect.DeepEqual(want, have[0]) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,173 @@
+package jaeger
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
+)
+
+const debugFlag = 2
+
+// Tags with a special meaning in OpenTracing, which become the span's kind
+// and remote endpoint rather than tags.
+const (
+	tagSpanKind = "span.kind"
+	tagPeerName = "peer.service"
+	tagPeerIPv4 = "peer.ipv4"
+	tagPeerPort = "peer.port"
+	tagIP       = "ip"
+)
+
+// endpoint returns the endpoint for a process.  Of its tags, only the IP
+// address is kept.
+func (p *Process) endpoint() *model.Endpoint {
+	endpoint := &model.Endpoint{ServiceName: p.ServiceName}
+	for _, tag := range p.Tags {
+		if tag.Key == tagIP {
+			endpoint.IPv4 = tagIPv4(tag)
+		}
+	}
+	return endpoint
+}
+
+// tagIPv4 reads an IPv4 address, which clients send either as a dotted string
+// or as a number.
+func tagIPv4(tag Tag) net.IP {
+	switch tag.VType {
+	case tagString:
+		return net.ParseIP(tag.VStr).To4()
+	case tagLong:
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(tag.VLong))
+		return ip
+	}
+	return nil
+}
+
+// tag converts a tag to the model's typed tag.
+func (t Tag) tag() model.Tag {
+	switch t.VType {
+	case tagDouble:
+		return model.FloatTag(t.Key, t.VDouble)
+	case tagBool:
+		return model.BoolTag(t.Key, t.VBool)
+	case tagLong:
+		return model.IntTag(t.Key, t.VLong)
+	case tagBinary:
+		return model.BytesTag(t.Key, t.VBinary)
+	default:
+		return model.StringTag(t.Key, t.VStr)
+	}
+}
+
+func (t Tag) String() string {
+	switch t.VType {
+	case tagDouble:
+		return fmt.Sprint(t.VDouble)
+	case tagBool:
+		return fmt.Sprint(t.VBool)
+	case tagLong:
+		return fmt.Sprint(t.VLong)
+	case tagBinary:
+		return fmt.Sprintf("%x", t.VBinary)
+	default:
+		return t.VStr
+	}
+}
+
+// annotationValue describes a log as a single string: the event, if that's
+// all it has, otherwise each field as key=value.
+func (l *Log) annotationValue() string {
+	if len(l.Fields) == 1 && l.Fields[0].Key == "event" {
+		return l.Fields[0].String()
+	}
+	fields := make([]string, 0, len(l.Fields))
+	for _, field := range l.Fields {
+		fields = append(fields, field.Key+"="+field.String())
+	}
+	return strings.Join(fields, " ")
+}
+
+// parentID returns the span's parent: its parent span ID if set, otherwise
+// the span it references in the same trace, preferring a child-of reference.
+func (s *Span) parentID() model.SpanID {
+	if s.ParentSpanID != 0 {
+		return model.SpanID(s.ParentSpanID)
+	}
+	var parentID model.SpanID
+	for _, ref := range s.References {
+		if ref.TraceIDLow != s.TraceIDLow || ref.TraceIDHigh != s.TraceIDHigh {
+			continue
+		}
+		if parentID == 0 || ref.RefType == refChildOf {
+			parentID = model.SpanID(ref.SpanID)
+		}
+		if ref.RefType == refChildOf {
+			break
+		}
+	}
+	return parentID
+}
+
+// links returns the spans referenced other than the parent: those the span
+// follows from, or in other traces.
+func (s *Span) links(parentID model.SpanID) []model.Link {
+	var links []model.Link
+	for _, ref := range s.References {
+		if ref.TraceIDLow == s.TraceIDLow && ref.TraceIDHigh == s.TraceIDHigh && model.SpanID(ref.SpanID) == parentID {
+			continue
+		}
+		links = append(links, model.Link{
+			TraceID: model.TraceID{High: uint64(ref.TraceIDHigh), Low: uint64(ref.TraceIDLow)},
+			SpanID:  model.SpanID(ref.SpanID),
+		})
+	}
+	return links
+}
+
+// ToSpan converts a span reported by process to the model.
+func ToSpan(process *Process, span *Span) *model.Span {
+	result := &model.Span{
+		TraceID:       model.TraceID{High: uint64(span.TraceIDHigh), Low: uint64(span.TraceIDLow)},
+		ID:            model.SpanID(span.SpanID),
+		ParentID:      span.parentID(),
+		Name:          span.OperationName,
+		Timestamp:     span.StartTime,
+		Duration:      span.Duration,
+		Debug:         span.Flags&debugFlag != 0,
+		LocalEndpoint: process.endpoint(),
+	}
+	result.Links = span.links(result.ParentID)
+	for _, tag := range span.Tags {
+		switch tag.Key {
+		case tagSpanKind:
+			// Unknown kinds are left as local spans.
+			result.Kind, _ = model.ParseKind(strings.ToUpper(tag.VStr))
+			continue
+		case tagPeerName, tagPeerIPv4, tagPeerPort:
+			if result.RemoteEndpoint == nil {
+				result.RemoteEndpoint = &model.Endpoint{}
+			}
+			switch tag.Key {
+			case tagPeerName:
+				result.RemoteEndpoint.ServiceName = tag.VStr
+			case tagPeerIPv4:
+				result.RemoteEndpoint.IPv4 = tagIPv4(tag)
+			case tagPeerPort:
+				result.RemoteEndpoint.Port = model.Port(tag.VLong)
+			}
+			continue
+		}
+		result.Tags = append(result.Tags, tag.tag())
+	}
+	for i := range span.Logs {
+		result.Events = append(result.Events, model.Event{
+			Timestamp: span.Logs[i].Timestamp,
+			Name:      span.Logs[i].annotationValue(),
+		})
+	}
+	return result
+}
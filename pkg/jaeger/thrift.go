@@ -0,0 +1,305 @@
+package jaeger
+
+import (
+	"fmt"
+
+	"github.com/apache/thrift/lib/go/thrift"
+)
+
+// The subset of Jaeger's jaeger.thrift and agent.thrift we need to decode the
+// batches its clients emit.  Unknown fields are skipped, as thrift's generated
+// code would.
+
+// Tag value types.
+const (
+	tagString = 0
+	tagDouble = 1
+	tagBool   = 2
+	tagLong   = 3
+	tagBinary = 4
+)
+
+// Span reference types.
+const (
+	refChildOf     = 0
+	refFollowsFrom = 1
+)
+
+// Tag is a typed key-value pair.
+type Tag struct {
+	Key     string
+	VType   int32
+	VStr    string
+	VDouble float64
+	VBool   bool
+	VLong   int64
+	VBinary []byte
+}
+
+// Log is a set of fields recorded at a point in a span.
+type Log struct {
+	Timestamp int64
+	Fields    []Tag
+}
+
+// SpanRef is a causal reference from one span to another.
+type SpanRef struct {
+	RefType     int32
+	TraceIDLow  int64
+	TraceIDHigh int64
+	SpanID      int64
+}
+
+// Span is a single Jaeger span.  Times are in microseconds.
+type Span struct {
+	TraceIDLow    int64
+	TraceIDHigh   int64
+	SpanID        int64
+	ParentSpanID  int64
+	OperationName string
+	References    []SpanRef
+	Flags         int32
+	StartTime     int64
+	Duration      int64
+	Tags          []Tag
+	Logs          []Log
+}
+
+// Process describes the service that reported a batch of spans.
+type Process struct {
+	ServiceName string
+	Tags        []Tag
+}
+
+// Batch is the unit Jaeger clients report in.
+type Batch struct {
+	Process Process
+	Spans   []Span
+}
+
+// readStruct reads a struct, calling field for each field in it.  field
+// returns false for fields it doesn't know, which are skipped.
+func readStruct(p thrift.TProtocol, field func(id int16, typ thrift.TType) (bool, error)) error {
+	if _, err := p.ReadStructBegin(); err != nil {
+		return err
+	}
+	for {
+		_, typ, id, err := p.ReadFieldBegin()
+		if err != nil {
+			return err
+		}
+		if typ == thrift.STOP {
+			break
+		}
+		ok, err := field(id, typ)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err := p.Skip(typ); err != nil {
+				return err
+			}
+		}
+		if err := p.ReadFieldEnd(); err != nil {
+			return err
+		}
+	}
+	return p.ReadStructEnd()
+}
+
+// readList reads a list of structs, calling elem for each.
+func readList(p thrift.TProtocol, elem func() error) error {
+	typ, size, err := p.ReadListBegin()
+	if err != nil {
+		return err
+	}
+	if typ != thrift.STRUCT {
+		return fmt.Errorf("unexpected list of %v", typ)
+	}
+	for i := 0; i < size; i++ {
+		if err := elem(); err != nil {
+			return err
+		}
+	}
+	return p.ReadListEnd()
+}
+
+func readTags(p thrift.TProtocol) ([]Tag, error) {
+	var tags []Tag
+	err := readList(p, func() error {
+		var tag Tag
+		if err := tag.read(p); err != nil {
+			return err
+		}
+		tags = append(tags, tag)
+		return nil
+	})
+	return tags, err
+}
+
+func (t *Tag) read(p thrift.TProtocol) error {
+	return readStruct(p, func(id int16, typ thrift.TType) (ok bool, err error) {
+		switch {
+		case id == 1 && typ == thrift.STRING:
+			t.Key, err = p.ReadString()
+		case id == 2 && typ == thrift.I32:
+			t.VType, err = p.ReadI32()
+		case id == 3 && typ == thrift.STRING:
+			t.VStr, err = p.ReadString()
+		case id == 4 && typ == thrift.DOUBLE:
+			t.VDouble, err = p.ReadDouble()
+		case id == 5 && typ == thrift.BOOL:
+			t.VBool, err = p.ReadBool()
+		case id == 6 && typ == thrift.I64:
+			t.VLong, err = p.ReadI64()
+		case id == 7 && typ == thrift.STRING:
+			t.VBinary, err = p.ReadBinary()
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+func (l *Log) read(p thrift.TProtocol) error {
+	return readStruct(p, func(id int16, typ thrift.TType) (ok bool, err error) {
+		switch {
+		case id == 1 && typ == thrift.I64:
+			l.Timestamp, err = p.ReadI64()
+		case id == 2 && typ == thrift.LIST:
+			l.Fields, err = readTags(p)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+func (r *SpanRef) read(p thrift.TProtocol) error {
+	return readStruct(p, func(id int16, typ thrift.TType) (ok bool, err error) {
+		switch {
+		case id == 1 && typ == thrift.I32:
+			r.RefType, err = p.ReadI32()
+		case id == 2 && typ == thrift.I64:
+			r.TraceIDLow, err = p.ReadI64()
+		case id == 3 && typ == thrift.I64:
+			r.TraceIDHigh, err = p.ReadI64()
+		case id == 4 && typ == thrift.I64:
+			r.SpanID, err = p.ReadI64()
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+func (s *Span) read(p thrift.TProtocol) error {
+	return readStruct(p, func(id int16, typ thrift.TType) (ok bool, err error) {
+		switch {
+		case id == 1 && typ == thrift.I64:
+			s.TraceIDLow, err = p.ReadI64()
+		case id == 2 && typ == thrift.I64:
+			s.TraceIDHigh, err = p.ReadI64()
+		case id == 3 && typ == thrift.I64:
+			s.SpanID, err = p.ReadI64()
+		case id == 4 && typ == thrift.I64:
+			s.ParentSpanID, err = p.ReadI64()
+		case id == 5 && typ == thrift.STRING:
+			s.OperationName, err = p.ReadString()
+		case id == 6 && typ == thrift.LIST:
+			err = readList(p, func() error {
+				var ref SpanRef
+				if err := ref.read(p); err != nil {
+					return err
+				}
+				s.References = append(s.References, ref)
+				return nil
+			})
+		case id == 7 && typ == thrift.I32:
+			s.Flags, err = p.ReadI32()
+		case id == 8 && typ == thrift.I64:
+			s.StartTime, err = p.ReadI64()
+		case id == 9 && typ == thrift.I64:
+			s.Duration, err = p.ReadI64()
+		case id == 10 && typ == thrift.LIST:
+			s.Tags, err = readTags(p)
+		case id == 11 && typ == thrift.LIST:
+			err = readList(p, func() error {
+				var log Log
+				if err := log.read(p); err != nil {
+					return err
+				}
+				s.Logs = append(s.Logs, log)
+				return nil
+			})
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+func (pr *Process) read(p thrift.TProtocol) error {
+	return readStruct(p, func(id int16, typ thrift.TType) (ok bool, err error) {
+		switch {
+		case id == 1 && typ == thrift.STRING:
+			pr.ServiceName, err = p.ReadString()
+		case id == 2 && typ == thrift.LIST:
+			pr.Tags, err = readTags(p)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+func (b *Batch) read(p thrift.TProtocol) error {
+	return readStruct(p, func(id int16, typ thrift.TType) (ok bool, err error) {
+		switch {
+		case id == 1 && typ == thrift.STRUCT:
+			err = b.Process.read(p)
+		case id == 2 && typ == thrift.LIST:
+			err = readList(p, func() error {
+				var span Span
+				if err := span.read(p); err != nil {
+					return err
+				}
+				b.Spans = append(b.Spans, span)
+				return nil
+			})
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+// ReadEmitBatch reads a call to the agent's oneway emitBatch(1: Batch batch).
+func ReadEmitBatch(p thrift.TProtocol) (*Batch, error) {
+	name, typ, _, err := p.ReadMessageBegin()
+	if err != nil {
+		return nil, err
+	}
+	if typ != thrift.ONEWAY && typ != thrift.CALL {
+		return nil, fmt.Errorf("unexpected message type %v", typ)
+	}
+	if name != "emitBatch" {
+		return nil, fmt.Errorf("unexpected method %q", name)
+	}
+
+	var batch *Batch
+	err = readStruct(p, func(id int16, typ thrift.TType) (bool, error) {
+		if id != 1 || typ != thrift.STRUCT {
+			return false, nil
+		}
+		batch = &Batch{}
+		return true, batch.read(p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if batch == nil {
+		return nil, fmt.Errorf("emitBatch without a batch")
+	}
+	return batch, p.ReadMessageEnd()
+}
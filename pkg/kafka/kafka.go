@@ -0,0 +1,278 @@
+package kafka
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
+)
+
+// Config configures the Kafka ingester.
+type Config struct {
+	Brokers       string
+	Topic         string
+	Group         string
+	InitialOffset string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Brokers, "kafka.brokers", "", "Comma-separated Kafka brokers to consume spans from; empty disables Kafka.")
+	f.StringVar(&cfg.Topic, "kafka.topic", "zipkin", "Kafka topic to consume spans from.")
+	f.StringVar(&cfg.Group, "kafka.group", "loki", "Kafka consumer group to commit offsets as.")
+	f.StringVar(&cfg.InitialOffset, "kafka.initial-offset", "newest", "Where to start consuming partitions with no committed offset (oldest or newest).")
+}
+
+// How long to wait before retrying a message whose spans couldn't be
+// appended, doubling after each failure.
+const (
+	minRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff = 10 * time.Second
+)
+
+// Appender stores the spans consumed.
+type Appender interface {
+	Append(*zipkincore.Span) error
+}
+
+// Ingester consumes every partition of a topic, appending the spans in each
+// message.  Offsets are committed for the consumer group, so a restarted
+// ingester resumes where it left off; partitions aren't balanced between
+// members of the group, so only run one ingester per group.
+type Ingester struct {
+	appender Appender
+	client   sarama.Client
+	consumer sarama.Consumer
+	offsets  sarama.OffsetManager
+
+	partitions []sarama.PartitionConsumer
+	managers   []sarama.PartitionOffsetManager
+	wg         sync.WaitGroup
+	quit       chan struct{}
+}
+
+// New connects to Kafka and starts consuming.
+func New(cfg Config, appender Appender) (*Ingester, error) {
+	conf := sarama.NewConfig()
+	conf.ClientID = "loki"
+	conf.Consumer.Return.Errors = true
+	switch cfg.InitialOffset {
+	case "oldest":
+		conf.Consumer.Offsets.Initial = sarama.OffsetOldest
+	case "newest":
+		conf.Consumer.Offsets.Initial = sarama.OffsetNewest
+	default:
+		return nil, fmt.Errorf("unknown initial offset %q", cfg.InitialOffset)
+	}
+
+	client, err := sarama.NewClient(strings.Split(cfg.Brokers, ","), conf)
+	if err != nil {
+		return nil, err
+	}
+	i := &Ingester{
+		appender: appender,
+		client:   client,
+		quit:     make(chan struct{}),
+	}
+	if err := i.start(cfg.Topic, cfg.Group); err != nil {
+		i.Stop()
+		return nil, err
+	}
+	return i, nil
+}
+
+func (i *Ingester) start(topic, group string) error {
+	var err error
+	if i.consumer, err = sarama.NewConsumerFromClient(i.client); err != nil {
+		return err
+	}
+	if i.offsets, err = sarama.NewOffsetManagerFromClient(group, i.client); err != nil {
+		return err
+	}
+	partitions, err := i.consumer.Partitions(topic)
+	if err != nil {
+		return err
+	}
+
+	for _, partition := range partitions {
+		manager, err := i.offsets.ManagePartition(topic, partition)
+		if err != nil {
+			return err
+		}
+		i.managers = append(i.managers, manager)
+
+		// If the committed offset has been deleted, fall back to the initial
+		// one.
+		offset, _ := manager.NextOffset()
+		consumer, err := i.consumer.ConsumePartition(topic, partition, offset)
+		if err == sarama.ErrOffsetOutOfRange {
+			offset = i.client.Config().Consumer.Offsets.Initial
+			consumer, err = i.consumer.ConsumePartition(topic, partition, offset)
+		}
+		if err != nil {
+			return err
+		}
+		i.partitions = append(i.partitions, consumer)
+
+		log.Infof("Consuming %s/%d from offset %d", topic, partition, offset)
+		i.wg.Add(1)
+		go i.consume(consumer, manager)
+	}
+	return nil
+}
+
+func (i *Ingester) consume(consumer sarama.PartitionConsumer, manager sarama.PartitionOffsetManager) {
+	defer i.wg.Done()
+
+	// The offset manager's errors are drained by its Close once we're done.
+	messages, errors := consumer.Messages(), consumer.Errors()
+	for messages != nil || errors != nil {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				messages = nil
+				continue
+			}
+			// Once stopped, messages are drained until the partition
+			// consumer closes, but no longer retried.
+			if !i.ingestRetrying(message) {
+				continue
+			}
+			manager.MarkOffset(message.Offset+1, "")
+
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			log.Errorf("Error consuming %s/%d: %v", err.Topic, err.Partition, err.Err)
+
+		case err := <-manager.Errors():
+			log.Errorf("Error committing offset for %s/%d: %v", err.Topic, err.Partition, err.Err)
+		}
+	}
+}
+
+// ingestRetrying ingests a message, retrying with backoff until its spans are
+// stored, so its offset is never committed before then.  It returns false if
+// the ingester is stopped first.
+func (i *Ingester) ingestRetrying(message *sarama.ConsumerMessage) bool {
+	backoff := minRetryBackoff
+	for {
+		err := i.ingest(message)
+		if err == nil {
+			return true
+		}
+		log.Errorf("Error appending spans from %s/%d/%d, retrying in %s: %v", message.Topic, message.Partition, message.Offset, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-i.quit:
+			return false
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// ingest appends the spans in a message.  Messages which can't be decoded are
+// logged and skipped, so they don't hold up the partition, as retrying won't
+// help; errors storing spans are returned.
+func (i *Ingester) ingest(message *sarama.ConsumerMessage) error {
+	spans, err := DecodeSpans(message.Value)
+	if err != nil {
+		log.Errorf("Error decoding message %s/%d/%d: %v", message.Topic, message.Partition, message.Offset, err)
+		return nil
+	}
+	for _, span := range spans {
+		if err := i.appender.Append(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop stops consuming, and commits the offsets of the messages ingested.
+func (i *Ingester) Stop() error {
+	close(i.quit)
+	for _, consumer := range i.partitions {
+		consumer.AsyncClose()
+	}
+	i.wg.Wait()
+
+	var firstErr error
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, manager := range i.managers {
+		record(manager.Close())
+	}
+	if i.offsets != nil {
+		record(i.offsets.Close())
+	}
+	if i.consumer != nil {
+		record(i.consumer.Close())
+	}
+	record(i.client.Close())
+	return firstErr
+}
+
+// DecodeSpans decodes a message as written by Zipkin's Kafka collectors:
+// either a single span or a list of spans using thrift's binary protocol, or
+// a JSON list of spans.
+func DecodeSpans(value []byte) ([]*zipkincore.Span, error) {
+	switch {
+	case len(value) == 0:
+		return nil, nil
+	case value[0] == '[':
+		return model.ZipkinSpansFromJSON(bytes.NewReader(value))
+	}
+
+	transport := thrift.NewTMemoryBuffer()
+	transport.Write(value)
+	protocol := thrift.NewTBinaryProtocolTransport(transport)
+
+	// A list starts with its element type; a span with the type of its first
+	// field, trace_id, which is an i64.
+	if value[0] != thrift.STRUCT {
+		span := zipkincore.NewSpan()
+		if err := span.Read(protocol); err != nil {
+			return nil, err
+		}
+		return []*zipkincore.Span{span}, nil
+	}
+
+	ttype, size, err := protocol.ReadListBegin()
+	if err != nil {
+		return nil, err
+	}
+	if ttype != thrift.STRUCT {
+		return nil, fmt.Errorf("unexpected type: %v", ttype)
+	}
+
+	// A corrupt size could have us allocate far too much; every span takes
+	// at least a byte.
+	if size > len(value) {
+		return nil, fmt.Errorf("list of %d spans in %d bytes", size, len(value))
+	}
+	spans := make([]*zipkincore.Span, 0, size)
+	for j := 0; j < size; j++ {
+		span := zipkincore.NewSpan()
+		if err := span.Read(protocol); err != nil {
+			return nil, err
+		}
+		spans = append(spans, span)
+	}
+	return spans, protocol.ReadListEnd()
+}
@@ -0,0 +1,141 @@
+package kafka
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+
+	"github.com/weaveworks-experiments/loki/pkg/appendertest"
+)
+
+func newTestSpan(traceID int64) *zipkincore.Span {
+	span := zipkincore.NewSpan()
+	span.TraceID = traceID
+	span.ID = traceID
+	span.Name = "get"
+	return span
+}
+
+// encodeSpans encodes a single span, or a list of spans, using thrift's binary
+// protocol.
+func encodeSpans(t *testing.T, spans ...*zipkincore.Span) []byte {
+	transport := thrift.NewTMemoryBuffer()
+	protocol := thrift.NewTBinaryProtocolTransport(transport)
+	var err error
+	if len(spans) == 1 {
+		err = spans[0].Write(protocol)
+	} else {
+		err = protocol.WriteListBegin(thrift.STRUCT, len(spans))
+		for _, span := range spans {
+			if err == nil {
+				err = span.Write(protocol)
+			}
+		}
+		if err == nil {
+			err = protocol.WriteListEnd()
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport.Bytes()
+}
+
+func TestIngester(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	// The group has already committed offset 1, so the first message is
+	// skipped; the last one can't be decoded.
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("zipkin", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("zipkin", 0, sarama.OffsetOldest, 0).
+			SetOffset("zipkin", 0, sarama.OffsetNewest, 4),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 4).
+			SetMessage("zipkin", 0, 0, sarama.ByteEncoder(encodeSpans(t, newTestSpan(1)))).
+			SetMessage("zipkin", 0, 1, sarama.ByteEncoder(encodeSpans(t, newTestSpan(2)))).
+			SetMessage("zipkin", 0, 2, sarama.ByteEncoder(encodeSpans(t, newTestSpan(3), newTestSpan(4)))).
+			SetMessage("zipkin", 0, 3, sarama.StringEncoder("garbage")).
+			SetHighWaterMark("zipkin", 0, 4),
+		"ConsumerMetadataRequest": sarama.NewMockConsumerMetadataResponse(t).
+			SetCoordinator("loki", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("loki", "zipkin", 0, 1, "", sarama.ErrNoError),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+	})
+
+	appender := &appendertest.Appender{}
+	ingester, err := New(Config{
+		Brokers:       broker.Addr(),
+		Topic:         "zipkin",
+		Group:         "loki",
+		InitialOffset: "oldest",
+	}, appender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int64{2, 3, 4}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(want, appender.TraceIDs()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %v, have %v", want, appender.TraceIDs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := ingester.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestRetries(t *testing.T) {
+	message := &sarama.ConsumerMessage{Topic: "zipkin", Value: encodeSpans(t, newTestSpan(1))}
+	appender := &appendertest.Appender{Failures: 2}
+	ingester := &Ingester{appender: appender, quit: make(chan struct{})}
+	if !ingester.ingestRetrying(message) {
+		t.Fatal("expected the message to be ingested")
+	}
+	if want, have := []int64{1}, appender.TraceIDs(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+
+	// Once stopped, a failing message is given up on, so its offset isn't
+	// committed.
+	appender.Failures = 1
+	close(ingester.quit)
+	if ingester.ingestRetrying(message) {
+		t.Fatal("expected the message not to be ingested")
+	}
+}
+
+func TestDecodeSpans(t *testing.T) {
+	for _, tc := range []struct {
+		value []byte
+		want  []int64
+	}{
+		{nil, []int64{}},
+		{encodeSpans(t, newTestSpan(1)), []int64{1}},
+		{encodeSpans(t, newTestSpan(1), newTestSpan(2)), []int64{1, 2}},
+		{[]byte(`[{"traceId":"000000000000000a","id":"000000000000000b","name":"get"}]`), []int64{10}},
+	} {
+		spans, err := DecodeSpans(tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := appendertest.TraceIDs(spans); !reflect.DeepEqual(tc.want, have) {
+			t.Fatalf("want %v, have %v", tc.want, have)
+		}
+	}
+
+	// A list claiming more spans than the message could hold.
+	if _, err := DecodeSpans([]byte{thrift.STRUCT, 0x7f, 0xff, 0xff, 0xff}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,192 @@
+package model
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+)
+
+// Span is Loki's own model of a span, independent of any wire format.  It
+// follows Zipkin v2 and OpenTelemetry: a span has a kind, and explicit local
+// and remote endpoints, rather than core annotations each carrying a host.
+type Span struct {
+	TraceID  TraceID
+	ID       SpanID
+	ParentID SpanID // zero for a root span
+	Name     string
+	Kind     Kind
+
+	// Timestamp and Duration are in microseconds.  A shared span was started
+	// by someone else, so the other side owns its timestamp.
+	Timestamp int64
+	Duration  int64
+	Shared    bool
+	Debug     bool
+
+	LocalEndpoint  *Endpoint
+	RemoteEndpoint *Endpoint
+
+	Tags   []Tag
+	Events []Event
+	Links  []Link
+}
+
+// SpanID identifies a span within its trace.
+type SpanID uint64
+
+// String returns the ID as 16 characters of lower-case hex.
+func (id SpanID) String() string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// ParseSpanID parses a hex span ID of up to 16 characters.
+func ParseSpanID(s string) (SpanID, error) {
+	if len(s) == 0 || len(s) > 16 {
+		return 0, fmt.Errorf("invalid span id %q", s)
+	}
+	id, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid span id %q", s)
+	}
+	return SpanID(id), nil
+}
+
+// Kind is the part a span plays in an RPC or message exchange.
+type Kind int8
+
+// The zero Kind is a local span, which doesn't talk to anyone.
+const (
+	KindLocal Kind = iota
+	KindClient
+	KindServer
+	KindProducer
+	KindConsumer
+)
+
+var kindNames = []string{"", "CLIENT", "SERVER", "PRODUCER", "CONSUMER"}
+
+// String returns the Zipkin v2 name of the kind; local spans have none.
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return fmt.Sprintf("Kind(%d)", k)
+	}
+	return kindNames[k]
+}
+
+// ParseKind parses a Zipkin v2 span kind.
+func ParseKind(s string) (Kind, error) {
+	for i, name := range kindNames {
+		if name == s {
+			return Kind(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown span kind %q", s)
+}
+
+// Endpoint is a network service.
+type Endpoint struct {
+	ServiceName string
+	IPv4        net.IP
+	IPv6        net.IP
+	Port        uint16
+}
+
+// Port returns an integer port as a uint16, or 0, meaning unknown, if it's
+// out of range.
+func Port(port int64) uint16 {
+	if port < 0 || port > math.MaxUint16 {
+		return 0
+	}
+	return uint16(port)
+}
+
+// ValueType is the type of a tag's value.
+type ValueType int8
+
+// Tag value types.
+const (
+	StringValue ValueType = iota
+	BoolValue
+	IntValue
+	FloatValue
+	BytesValue
+)
+
+// Tag is a typed key/value pair.  Only the field for its Type is set.
+type Tag struct {
+	Key   string
+	Type  ValueType
+	Str   string
+	Bool  bool
+	Int   int64
+	Float float64
+	Bytes []byte
+}
+
+// StringTag makes a string tag.
+func StringTag(key, value string) Tag {
+	return Tag{Key: key, Type: StringValue, Str: value}
+}
+
+// BoolTag makes a boolean tag.
+func BoolTag(key string, value bool) Tag {
+	return Tag{Key: key, Type: BoolValue, Bool: value}
+}
+
+// IntTag makes an integer tag.
+func IntTag(key string, value int64) Tag {
+	return Tag{Key: key, Type: IntValue, Int: value}
+}
+
+// FloatTag makes a floating point tag.
+func FloatTag(key string, value float64) Tag {
+	return Tag{Key: key, Type: FloatValue, Float: value}
+}
+
+// BytesTag makes a binary tag.
+func BytesTag(key string, value []byte) Tag {
+	return Tag{Key: key, Type: BytesValue, Bytes: value}
+}
+
+// Value returns the tag's value.
+func (t Tag) Value() interface{} {
+	switch t.Type {
+	case BoolValue:
+		return t.Bool
+	case IntValue:
+		return t.Int
+	case FloatValue:
+		return t.Float
+	case BytesValue:
+		return t.Bytes
+	default:
+		return t.Str
+	}
+}
+
+// ValueString formats the tag's value as a string, as Zipkin v2 tags are;
+// binary values are base64 encoded.
+func (t Tag) ValueString() string {
+	switch t.Type {
+	case StringValue:
+		return t.Str
+	case BytesValue:
+		return base64.StdEncoding.EncodeToString(t.Bytes)
+	default:
+		return fmt.Sprint(t.Value())
+	}
+}
+
+// Event is something that happened during a span; a Zipkin annotation.
+type Event struct {
+	Timestamp int64 // microseconds
+	Name      string
+}
+
+// Link refers to a span, in this trace or another, other than the parent.
+type Link struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
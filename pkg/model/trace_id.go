@@ -0,0 +1,63 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+)
+
+// TraceID identifies a trace.  IDs are 128 bits, as in W3C, B3 and OTLP;
+// 64-bit IDs, which older Zipkin clients still send, have a zero High.
+type TraceID struct {
+	High, Low uint64
+}
+
+// String returns the ID as lower-case hex: 16 characters for a 64-bit ID,
+// and 32 for a 128-bit one.
+func (id TraceID) String() string {
+	if id.High == 0 {
+		return fmt.Sprintf("%016x", id.Low)
+	}
+	return fmt.Sprintf("%016x%016x", id.High, id.Low)
+}
+
+// ParseTraceID parses a hex trace ID of up to 32 characters, with or without
+// leading zeros.  IDs of up to 16 characters are 64-bit.
+func ParseTraceID(s string) (TraceID, error) {
+	if len(s) == 0 || len(s) > 32 {
+		return TraceID{}, fmt.Errorf("invalid trace id %q", s)
+	}
+	var id TraceID
+	var err error
+	low := s
+	if len(s) > 16 {
+		low = s[len(s)-16:]
+		if id.High, err = strconv.ParseUint(s[:len(s)-16], 16, 64); err != nil {
+			return TraceID{}, fmt.Errorf("invalid trace id %q", s)
+		}
+	}
+	if id.Low, err = strconv.ParseUint(low, 16, 64); err != nil {
+		return TraceID{}, fmt.Errorf("invalid trace id %q", s)
+	}
+	return id, nil
+}
+
+// ZipkinTraceID returns the trace ID of a Zipkin span.
+func ZipkinTraceID(span *zipkincore.Span) TraceID {
+	return TraceID{
+		High: uint64(span.GetTraceIDHigh()),
+		Low:  uint64(span.GetTraceID()),
+	}
+}
+
+// SetZipkinTraceID sets the trace ID of a Zipkin span.  Thrift has no
+// unsigned integers, so the halves are stored as int64s.
+func SetZipkinTraceID(span *zipkincore.Span, id TraceID) {
+	span.TraceID = int64(id.Low)
+	span.TraceIDHigh = nil
+	if id.High != 0 {
+		high := int64(id.High)
+		span.TraceIDHigh = &high
+	}
+}
@@ -0,0 +1,35 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestParseTraceID(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+		want    TraceID
+	}{
+		{"1", "0000000000000001", TraceID{Low: 1}},
+		{"ffffffffffffffff", "ffffffffffffffff", TraceID{Low: 1<<64 - 1}},
+		{"10000000000000001", "00000000000000010000000000000001", TraceID{High: 1, Low: 1}},
+		{"463ac35c9f6413ad48485a3953bb6124", "463ac35c9f6413ad48485a3953bb6124", TraceID{High: 0x463ac35c9f6413ad, Low: 0x48485a3953bb6124}},
+		{"0000000000000000000000000000000a", "000000000000000a", TraceID{Low: 10}},
+	} {
+		id, err := ParseTraceID(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != tc.want {
+			t.Errorf("%s: want %v, have %v", tc.in, tc.want, id)
+		}
+		if id.String() != tc.out {
+			t.Errorf("%s: want %s, have %s", tc.in, tc.out, id)
+		}
+	}
+
+	for _, in := range []string{"", "x", "-1", "+1", "463ac35c9f6413ad48485a3953bb61240"} {
+		if _, err := ParseTraceID(in); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package model
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+)
+
+// Zipkin's thrift spans have no kind; instead core annotations mark when each
+// side of an RPC started and finished, and binary annotations name the remote
+// address.  Spans are converted to and from them as Zipkin itself does.
+
+const (
+	// Messaging core annotations, which the thrift doesn't define.
+	messageSend = "ms"
+	messageRecv = "mr"
+	messageAddr = "ma"
+
+	// linkKey is the binary annotation recording a link, as thrift has no
+	// links of its own.  Its value is "<trace id>:<span id>".
+	linkKey = "loki.link"
+)
+
+func endpointFromZipkin(endpoint *zipkincore.Endpoint) *Endpoint {
+	if endpoint == nil {
+		return nil
+	}
+	result := &Endpoint{
+		ServiceName: endpoint.ServiceName,
+		Port:        uint16(endpoint.Port),
+	}
+	if endpoint.Ipv4 != 0 {
+		result.IPv4 = make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(result.IPv4, uint32(endpoint.Ipv4))
+	}
+	if len(endpoint.Ipv6) == net.IPv6len {
+		result.IPv6 = net.IP(endpoint.Ipv6)
+	}
+	return result
+}
+
+func endpointToZipkin(endpoint *Endpoint) *zipkincore.Endpoint {
+	if endpoint == nil {
+		return nil
+	}
+	result := zipkincore.NewEndpoint()
+	result.ServiceName = endpoint.ServiceName
+	result.Port = int16(endpoint.Port) // ports above 32767 wrap, as in Zipkin
+	if ip := endpoint.IPv4.To4(); ip != nil {
+		result.Ipv4 = int32(binary.BigEndian.Uint32(ip))
+	}
+	if ip := endpoint.IPv6; len(ip) == net.IPv6len && ip.To4() == nil {
+		result.Ipv6 = []byte(ip)
+	}
+	return result
+}
+
+// tagFromZipkin decodes a binary annotation's big-endian value.  Values too
+// short for their type are kept as bytes.
+func tagFromZipkin(annotation *zipkincore.BinaryAnnotation) Tag {
+	value := annotation.Value
+	switch annotation.AnnotationType {
+	case zipkincore.AnnotationType_BOOL:
+		return BoolTag(annotation.Key, len(value) > 0 && value[0] == '\x01')
+	case zipkincore.AnnotationType_I16:
+		if len(value) >= 2 {
+			return IntTag(annotation.Key, int64(int16(binary.BigEndian.Uint16(value))))
+		}
+	case zipkincore.AnnotationType_I32:
+		if len(value) >= 4 {
+			return IntTag(annotation.Key, int64(int32(binary.BigEndian.Uint32(value))))
+		}
+	case zipkincore.AnnotationType_I64:
+		if len(value) >= 8 {
+			return IntTag(annotation.Key, int64(binary.BigEndian.Uint64(value)))
+		}
+	case zipkincore.AnnotationType_DOUBLE:
+		if len(value) >= 8 {
+			return FloatTag(annotation.Key, math.Float64frombits(binary.BigEndian.Uint64(value)))
+		}
+	case zipkincore.AnnotationType_STRING:
+		return StringTag(annotation.Key, string(value))
+	}
+	return BytesTag(annotation.Key, value)
+}
+
+func tagToZipkin(tag Tag, host *zipkincore.Endpoint) *zipkincore.BinaryAnnotation {
+	result := &zipkincore.BinaryAnnotation{
+		Key:  tag.Key,
+		Host: host,
+	}
+	switch tag.Type {
+	case BoolValue:
+		result.AnnotationType = zipkincore.AnnotationType_BOOL
+		result.Value = []byte{0}
+		if tag.Bool {
+			result.Value[0] = 1
+		}
+	case IntValue:
+		result.AnnotationType = zipkincore.AnnotationType_I64
+		result.Value = make([]byte, 8)
+		binary.BigEndian.PutUint64(result.Value, uint64(tag.Int))
+	case FloatValue:
+		result.AnnotationType = zipkincore.AnnotationType_DOUBLE
+		result.Value = make([]byte, 8)
+		binary.BigEndian.PutUint64(result.Value, math.Float64bits(tag.Float))
+	case BytesValue:
+		result.AnnotationType = zipkincore.AnnotationType_BYTES
+		result.Value = tag.Bytes
+	default:
+		result.AnnotationType = zipkincore.AnnotationType_STRING
+		result.Value = []byte(tag.Str)
+	}
+	return result
+}
+
+func parseLink(value string) (Link, bool) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return Link{}, false
+	}
+	traceID, err := ParseTraceID(parts[0])
+	if err != nil {
+		return Link{}, false
+	}
+	spanID, err := ParseSpanID(parts[1])
+	if err != nil {
+		return Link{}, false
+	}
+	return Link{TraceID: traceID, SpanID: spanID}, true
+}
+
+// FromZipkin converts a thrift span.  A thrift span can hold both the client
+// and server sides of an RPC, in which case there are two spans, the server's
+// being shared.
+func FromZipkin(span *zipkincore.Span) []*Span {
+	var spans []*Span
+	byKind := map[Kind]*Span{}
+	get := func(kind Kind, host *zipkincore.Endpoint) *Span {
+		if s, ok := byKind[kind]; ok {
+			if s.LocalEndpoint == nil {
+				s.LocalEndpoint = endpointFromZipkin(host)
+			}
+			return s
+		}
+		s := &Span{
+			TraceID:       ZipkinTraceID(span),
+			ID:            SpanID(span.ID),
+			ParentID:      SpanID(span.GetParentID()),
+			Name:          span.Name,
+			Kind:          kind,
+			Debug:         span.Debug,
+			LocalEndpoint: endpointFromZipkin(host),
+		}
+		byKind[kind] = s
+		spans = append(spans, s)
+		return s
+	}
+
+	// forHost returns the span recorded by host, or the first one.
+	forHost := func(host *zipkincore.Endpoint) *Span {
+		for _, s := range spans {
+			if host == nil || s.LocalEndpoint == nil || s.LocalEndpoint.ServiceName == host.ServiceName {
+				return s
+			}
+		}
+		if len(spans) > 0 {
+			return spans[0]
+		}
+		return get(KindLocal, host)
+	}
+
+	// Core annotations mark the start and end of each kind of span.
+	starts, ends := map[Kind]int64{}, map[Kind]int64{}
+	var others []*zipkincore.Annotation
+	for _, annotation := range span.Annotations {
+		switch annotation.Value {
+		case zipkincore.CLIENT_SEND:
+			get(KindClient, annotation.Host)
+			starts[KindClient] = annotation.Timestamp
+		case zipkincore.CLIENT_RECV:
+			get(KindClient, annotation.Host)
+			ends[KindClient] = annotation.Timestamp
+		case zipkincore.SERVER_RECV:
+			get(KindServer, annotation.Host)
+			starts[KindServer] = annotation.Timestamp
+		case zipkincore.SERVER_SEND:
+			get(KindServer, annotation.Host)
+			ends[KindServer] = annotation.Timestamp
+		case messageSend:
+			get(KindProducer, annotation.Host)
+			starts[KindProducer] = annotation.Timestamp
+		case messageRecv:
+			get(KindConsumer, annotation.Host)
+			starts[KindConsumer] = annotation.Timestamp
+		default:
+			others = append(others, annotation)
+		}
+	}
+	for _, s := range spans {
+		s.Timestamp = starts[s.Kind]
+		if end, ok := ends[s.Kind]; ok && s.Timestamp != 0 {
+			s.Duration = end - s.Timestamp
+		}
+	}
+
+	var tags []*zipkincore.BinaryAnnotation
+	for _, annotation := range span.BinaryAnnotations {
+		var kind Kind
+		switch annotation.Key {
+		case zipkincore.SERVER_ADDR:
+			kind = KindClient
+		case zipkincore.CLIENT_ADDR:
+			kind = KindServer
+		case messageAddr:
+			kind = KindProducer
+			if _, ok := byKind[KindConsumer]; ok {
+				kind = KindConsumer
+			}
+		case zipkincore.LOCAL_COMPONENT:
+			get(KindLocal, annotation.Host)
+			tags = append(tags, annotation)
+			continue
+		default:
+			tags = append(tags, annotation)
+			continue
+		}
+		if s, ok := byKind[kind]; ok {
+			s.RemoteEndpoint = endpointFromZipkin(annotation.Host)
+		}
+	}
+	for _, annotation := range others {
+		s := forHost(annotation.Host)
+		s.Events = append(s.Events, Event{
+			Timestamp: annotation.Timestamp,
+			Name:      annotation.Value,
+		})
+	}
+	for _, annotation := range tags {
+		tag := tagFromZipkin(annotation)
+		if tag.Key == linkKey && tag.Type == StringValue {
+			if link, ok := parseLink(tag.Str); ok {
+				s := forHost(annotation.Host)
+				s.Links = append(s.Links, link)
+				continue
+			}
+		}
+		if tag.Key != zipkincore.LOCAL_COMPONENT || tag.ValueString() != "" {
+			s := forHost(annotation.Host)
+			s.Tags = append(s.Tags, tag)
+		}
+	}
+	if len(spans) == 0 {
+		get(KindLocal, nil)
+	}
+
+	// The span's own timestamp and duration are authoritative, and belong to
+	// whoever started it: the client, if there is one.
+	if span.Timestamp != nil {
+		owner, ok := byKind[KindClient]
+		if !ok {
+			owner = spans[0]
+		}
+		owner.Timestamp = span.GetTimestamp()
+		owner.Duration = span.GetDuration()
+	}
+	if s, ok := byKind[KindServer]; ok && (span.Timestamp == nil || len(spans) > 1) {
+		s.Shared = true
+	}
+	return spans
+}
+
+// ToZipkin converts a span to thrift, adding the core annotations implied by
+// its kind.
+func ToZipkin(span *Span) *zipkincore.Span {
+	result := zipkincore.NewSpan()
+	SetZipkinTraceID(result, span.TraceID)
+	result.ID = int64(span.ID)
+	if span.ParentID != 0 {
+		parentID := int64(span.ParentID)
+		result.ParentID = &parentID
+	}
+	result.Name = span.Name
+	result.Debug = span.Debug
+
+	// Shared spans were started by someone else, who owns the timestamp.
+	if span.Timestamp != 0 && !span.Shared {
+		timestamp := span.Timestamp
+		result.Timestamp = &timestamp
+		if span.Duration != 0 {
+			duration := span.Duration
+			result.Duration = &duration
+		}
+	}
+
+	local, remote := endpointToZipkin(span.LocalEndpoint), endpointToZipkin(span.RemoteEndpoint)
+	var begin, end, addr string
+	switch span.Kind {
+	case KindClient:
+		begin, end, addr = zipkincore.CLIENT_SEND, zipkincore.CLIENT_RECV, zipkincore.SERVER_ADDR
+	case KindServer:
+		begin, end, addr = zipkincore.SERVER_RECV, zipkincore.SERVER_SEND, zipkincore.CLIENT_ADDR
+	case KindProducer:
+		begin, addr = messageSend, messageAddr
+	case KindConsumer:
+		begin, addr = messageRecv, messageAddr
+	}
+	if begin != "" && span.Timestamp != 0 {
+		result.Annotations = append(result.Annotations, &zipkincore.Annotation{
+			Timestamp: span.Timestamp,
+			Value:     begin,
+			Host:      local,
+		})
+	}
+	if end != "" && span.Timestamp != 0 && span.Duration != 0 {
+		result.Annotations = append(result.Annotations, &zipkincore.Annotation{
+			Timestamp: span.Timestamp + span.Duration,
+			Value:     end,
+			Host:      local,
+		})
+	}
+	for _, event := range span.Events {
+		result.Annotations = append(result.Annotations, &zipkincore.Annotation{
+			Timestamp: event.Timestamp,
+			Value:     event.Name,
+			Host:      local,
+		})
+	}
+
+	for _, tag := range span.Tags {
+		result.BinaryAnnotations = append(result.BinaryAnnotations, tagToZipkin(tag, local))
+	}
+	for _, link := range span.Links {
+		tag := StringTag(linkKey, link.TraceID.String()+":"+link.SpanID.String())
+		result.BinaryAnnotations = append(result.BinaryAnnotations, tagToZipkin(tag, local))
+	}
+	if addr != "" && remote != nil {
+		result.BinaryAnnotations = append(result.BinaryAnnotations, tagToZipkin(BoolTag(addr, true), remote))
+	}
+
+	// Make sure local spans are still found under their service.
+	if len(result.Annotations) == 0 && len(result.BinaryAnnotations) == 0 && local != nil {
+		result.BinaryAnnotations = append(result.BinaryAnnotations, tagToZipkin(StringTag(zipkincore.LOCAL_COMPONENT, ""), local))
+	}
+	return result
+}
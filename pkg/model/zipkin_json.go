@@ -0,0 +1,198 @@
+package model
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+)
+
+// Zipkin v1 JSON, as POSTed to /api/v1/spans.  Ports are unsigned, but thrift
+// only has signed types, so ports above 32767 are stored as negative int16s,
+// as Zipkin does.
+
+type wireEndpoint struct {
+	ServiceName string `json:"serviceName"`
+	Ipv4        string `json:"ipv4"`
+	Port        uint16 `json:"port"`
+}
+
+type wireAnnotation struct {
+	Endpoint  *wireEndpoint `json:"endpoint"`
+	Timestamp int64         `json:"timestamp"`
+	Value     string        `json:"value"`
+}
+
+type wireBinaryAnnotation struct {
+	Endpoint *wireEndpoint   `json:"endpoint"`
+	Key      string          `json:"key"`
+	Value    json.RawMessage `json:"value"`
+	Type     string          `json:"type"`
+}
+
+type wireSpan struct {
+	TraceID           string                 `json:"traceId"`
+	Name              string                 `json:"name"`
+	ID                string                 `json:"id"`
+	ParentID          string                 `json:"parentId"`
+	Timestamp         *int64                 `json:"timestamp"`
+	Duration          *int64                 `json:"duration"`
+	Debug             bool                   `json:"debug"`
+	Annotations       []wireAnnotation       `json:"annotations"`
+	BinaryAnnotations []wireBinaryAnnotation `json:"binaryAnnotations"`
+}
+
+// idFromWire parses a hex ID of up to 16 characters, with or without leading
+// zeros.
+func idFromWire(id string) (int64, error) {
+	u, err := strconv.ParseUint(id, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", id)
+	}
+	return int64(u), nil
+}
+
+func endpointFromWire(endpoint *wireEndpoint) *zipkincore.Endpoint {
+	if endpoint == nil {
+		return nil
+	}
+	result := zipkincore.NewEndpoint()
+	result.ServiceName = endpoint.ServiceName
+	result.Port = int16(endpoint.Port)
+	if ip := net.ParseIP(endpoint.Ipv4).To4(); ip != nil {
+		result.Ipv4 = int32(binary.BigEndian.Uint32(ip))
+	}
+	return result
+}
+
+// binaryAnnotationValueFromWire encodes a JSON value as Zipkin's thrift would.
+// Without a type, strings, bools and numbers are recognised, numbers being
+// I64 if they're integers and DOUBLE otherwise.
+func binaryAnnotationValueFromWire(annotation wireBinaryAnnotation) ([]byte, zipkincore.AnnotationType, error) {
+	typ := annotation.Type
+	if typ == "" {
+		typ = "STRING"
+		var b bool
+		var i int64
+		var f float64
+		switch {
+		case json.Unmarshal(annotation.Value, &b) == nil:
+			typ = "BOOL"
+		case json.Unmarshal(annotation.Value, &i) == nil:
+			typ = "I64"
+		case json.Unmarshal(annotation.Value, &f) == nil:
+			typ = "DOUBLE"
+		}
+	}
+	annotationType, err := zipkincore.AnnotationTypeFromString(typ)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var value []byte
+	switch annotationType {
+	case zipkincore.AnnotationType_BOOL:
+		var b bool
+		err = json.Unmarshal(annotation.Value, &b)
+		value = []byte{0}
+		if b {
+			value[0] = 1
+		}
+	case zipkincore.AnnotationType_BYTES:
+		err = json.Unmarshal(annotation.Value, &value)
+	case zipkincore.AnnotationType_I16:
+		var i int16
+		err = json.Unmarshal(annotation.Value, &i)
+		value = make([]byte, 2)
+		binary.BigEndian.PutUint16(value, uint16(i))
+	case zipkincore.AnnotationType_I32:
+		var i int32
+		err = json.Unmarshal(annotation.Value, &i)
+		value = make([]byte, 4)
+		binary.BigEndian.PutUint32(value, uint32(i))
+	case zipkincore.AnnotationType_I64:
+		var i int64
+		err = json.Unmarshal(annotation.Value, &i)
+		value = make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(i))
+	case zipkincore.AnnotationType_DOUBLE:
+		var f float64
+		err = json.Unmarshal(annotation.Value, &f)
+		value = make([]byte, 8)
+		binary.BigEndian.PutUint64(value, math.Float64bits(f))
+	case zipkincore.AnnotationType_STRING:
+		var s string
+		err = json.Unmarshal(annotation.Value, &s)
+		value = []byte(s)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s value for %q: %v", typ, annotation.Key, err)
+	}
+	return value, annotationType, nil
+}
+
+func spanFromWire(span wireSpan) (*zipkincore.Span, error) {
+	result := zipkincore.NewSpan()
+	traceID, err := ParseTraceID(span.TraceID)
+	if err != nil {
+		return nil, err
+	}
+	SetZipkinTraceID(result, traceID)
+	if result.ID, err = idFromWire(span.ID); err != nil {
+		return nil, err
+	}
+	if span.ParentID != "" {
+		parentID, err := idFromWire(span.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		result.ParentID = &parentID
+	}
+	result.Name = span.Name
+	result.Timestamp = span.Timestamp
+	result.Duration = span.Duration
+	result.Debug = span.Debug
+
+	for _, annotation := range span.Annotations {
+		result.Annotations = append(result.Annotations, &zipkincore.Annotation{
+			Timestamp: annotation.Timestamp,
+			Value:     annotation.Value,
+			Host:      endpointFromWire(annotation.Endpoint),
+		})
+	}
+	for _, annotation := range span.BinaryAnnotations {
+		value, annotationType, err := binaryAnnotationValueFromWire(annotation)
+		if err != nil {
+			return nil, err
+		}
+		result.BinaryAnnotations = append(result.BinaryAnnotations, &zipkincore.BinaryAnnotation{
+			Key:            annotation.Key,
+			Value:          value,
+			AnnotationType: annotationType,
+			Host:           endpointFromWire(annotation.Endpoint),
+		})
+	}
+	return result, nil
+}
+
+// ZipkinSpansFromJSON decodes a Zipkin v1 JSON list of spans.
+func ZipkinSpansFromJSON(r io.Reader) ([]*zipkincore.Span, error) {
+	var spans []wireSpan
+	if err := json.NewDecoder(r).Decode(&spans); err != nil {
+		return nil, err
+	}
+	result := make([]*zipkincore.Span, 0, len(spans))
+	for _, span := range spans {
+		s, err := spanFromWire(span)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
@@ -0,0 +1,75 @@
+package model
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+)
+
+func TestZipkinRoundTrip(t *testing.T) {
+	span := &Span{
+		TraceID:        TraceID{High: 1, Low: 2},
+		ID:             4,
+		ParentID:       3,
+		Name:           "get",
+		Kind:           KindClient,
+		Timestamp:      1000,
+		Duration:       10,
+		LocalEndpoint:  &Endpoint{ServiceName: "web", IPv4: net.IP{10, 0, 0, 1}, Port: 40000},
+		RemoteEndpoint: &Endpoint{ServiceName: "api"},
+		Tags: []Tag{
+			StringTag("http.path", "/users"),
+			BoolTag("error", true),
+			IntTag("http.status_code", 500),
+			FloatTag("load", 0.5),
+			BytesTag("payload", []byte{1, 2}),
+		},
+		Events: []Event{{Timestamp: 1005, Name: "retry"}},
+		Links:  []Link{{TraceID: TraceID{Low: 9}, SpanID: 8}},
+	}
+	have := FromZipkin(ToZipkin(span))
+	if want := []*Span{span}; !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %+v, have %+v", want, have)
+	}
+}
+
+func TestFromZipkinShared(t *testing.T) {
+	client := zipkincore.NewEndpoint()
+	client.ServiceName = "web"
+	server := zipkincore.NewEndpoint()
+	server.ServiceName = "api"
+	timestamp, duration := int64(1000), int64(20)
+	span := &zipkincore.Span{
+		TraceID:   1,
+		ID:        2,
+		Name:      "get",
+		Timestamp: &timestamp,
+		Duration:  &duration,
+		Annotations: []*zipkincore.Annotation{
+			{Timestamp: 1000, Value: zipkincore.CLIENT_SEND, Host: client},
+			{Timestamp: 1005, Value: zipkincore.SERVER_RECV, Host: server},
+			{Timestamp: 1010, Value: "cache miss", Host: server},
+			{Timestamp: 1015, Value: zipkincore.SERVER_SEND, Host: server},
+			{Timestamp: 1020, Value: zipkincore.CLIENT_RECV, Host: client},
+		},
+	}
+
+	want := []*Span{
+		{
+			TraceID: TraceID{Low: 1}, ID: 2, Name: "get", Kind: KindClient,
+			Timestamp: 1000, Duration: 20,
+			LocalEndpoint: &Endpoint{ServiceName: "web"},
+		},
+		{
+			TraceID: TraceID{Low: 1}, ID: 2, Name: "get", Kind: KindServer,
+			Timestamp: 1005, Duration: 10, Shared: true,
+			LocalEndpoint: &Endpoint{ServiceName: "api"},
+			Events:        []Event{{Timestamp: 1010, Name: "cache miss"}},
+		},
+	}
+	if have := FromZipkin(span); !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %+v, have %+v", want, have)
+	}
+}
@@ -0,0 +1,228 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
+)
+
+// Semantic convention attributes which become endpoints rather than tags.
+const (
+	attrServiceName = "service.name"
+	attrHostIP      = "net.host.ip"
+	attrHostPort    = "net.host.port"
+	attrPeerService = "peer.service"
+	attrPeerIP      = "net.peer.ip"
+	attrPeerPort    = "net.peer.port"
+)
+
+// OpenTelemetry's name for services which didn't say.
+const unknownService = "unknown_service"
+
+// value returns an attribute value as a plain Go value, as JSON would decode
+// it.
+func (v *AnyValue) value() interface{} {
+	switch {
+	case v == nil:
+		return nil
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return *v.IntValue
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.BytesValue != nil:
+		return v.BytesValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for _, value := range v.ArrayValue.Values {
+			values = append(values, value.value())
+		}
+		return values
+	case v.KvlistValue != nil:
+		values := make(map[string]interface{}, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.value()
+		}
+		return values
+	}
+	return nil
+}
+
+// str returns an attribute value as a string; composite values are JSON.
+func (v *AnyValue) str() string {
+	switch value := v.value().(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case []interface{}, map[string]interface{}:
+		buf, _ := json.Marshal(value)
+		return string(buf)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// tag converts an attribute to a typed tag.  Composite values have no
+// equivalent, so are stored as JSON strings.
+func tag(kv *KeyValue) model.Tag {
+	switch value := kv.Value.value().(type) {
+	case bool:
+		return model.BoolTag(kv.Key, value)
+	case int64:
+		return model.IntTag(kv.Key, value)
+	case float64:
+		return model.FloatTag(kv.Key, value)
+	case []byte:
+		return model.BytesTag(kv.Key, value)
+	default:
+		return model.StringTag(kv.Key, kv.Value.str())
+	}
+}
+
+// setEndpoint sets the field of endpoint an attribute describes, if any.
+func setEndpoint(endpoint *model.Endpoint, field string, value *AnyValue) {
+	switch field {
+	case "service":
+		endpoint.ServiceName = value.str()
+	case "ip":
+		if ip := net.ParseIP(value.str()).To4(); ip != nil {
+			endpoint.IPv4 = ip
+		}
+	case "port":
+		if value.IntValue != nil {
+			endpoint.Port = model.Port(*value.IntValue)
+		}
+	}
+}
+
+func resourceEndpoint(resource *Resource) *model.Endpoint {
+	endpoint := &model.Endpoint{ServiceName: unknownService}
+	if resource == nil {
+		return endpoint
+	}
+	for _, kv := range resource.Attributes {
+		switch kv.Key {
+		case attrServiceName:
+			setEndpoint(endpoint, "service", kv.Value)
+		case attrHostIP:
+			setEndpoint(endpoint, "ip", kv.Value)
+		case attrHostPort:
+			setEndpoint(endpoint, "port", kv.Value)
+		}
+	}
+	return endpoint
+}
+
+// id decodes an 8-byte big-endian ID; an empty one is zero.
+func id(b []byte) (int64, error) {
+	switch len(b) {
+	case 0:
+		return 0, nil
+	case 8:
+		return int64(binary.BigEndian.Uint64(b)), nil
+	}
+	return 0, fmt.Errorf("invalid id %x", b)
+}
+
+// spanKinds maps OpenTelemetry's span kinds to the model's; unspecified and
+// internal spans are local.
+var spanKinds = map[int32]model.Kind{
+	spanKindServer:   model.KindServer,
+	spanKindClient:   model.KindClient,
+	spanKindProducer: model.KindProducer,
+	spanKindConsumer: model.KindConsumer,
+}
+
+// toSpan converts a span from the resource with the given endpoint.
+func toSpan(local *model.Endpoint, span *Span) (*model.Span, error) {
+	if len(span.TraceID) != 16 {
+		return nil, fmt.Errorf("invalid trace id %x", span.TraceID)
+	}
+	result := &model.Span{
+		TraceID: model.TraceID{
+			High: binary.BigEndian.Uint64(span.TraceID[:8]),
+			Low:  binary.BigEndian.Uint64(span.TraceID[8:]),
+		},
+		Name:          span.Name,
+		Kind:          spanKinds[span.Kind],
+		LocalEndpoint: local,
+	}
+	spanID, err := id(span.SpanID)
+	if err != nil {
+		return nil, err
+	}
+	result.ID = model.SpanID(spanID)
+	parentID, err := id(span.ParentSpanID)
+	if err != nil {
+		return nil, err
+	}
+	result.ParentID = model.SpanID(parentID)
+
+	// Zipkin has microseconds; round short spans up rather than losing them.
+	result.Timestamp = int64(span.StartTimeUnixNano / 1000)
+	if span.EndTimeUnixNano > span.StartTimeUnixNano {
+		result.Duration = int64((span.EndTimeUnixNano - span.StartTimeUnixNano + 999) / 1000)
+	}
+
+	for _, kv := range span.Attributes {
+		var field string
+		switch kv.Key {
+		case attrPeerService:
+			field = "service"
+		case attrPeerIP:
+			field = "ip"
+		case attrPeerPort:
+			field = "port"
+		default:
+			result.Tags = append(result.Tags, tag(kv))
+			continue
+		}
+		if result.RemoteEndpoint == nil {
+			result.RemoteEndpoint = &model.Endpoint{}
+		}
+		setEndpoint(result.RemoteEndpoint, field, kv.Value)
+	}
+	for _, event := range span.Events {
+		result.Events = append(result.Events, model.Event{
+			Timestamp: int64(event.TimeUnixNano / 1000),
+			Name:      event.Name,
+		})
+	}
+
+	// Zipkin marks failed spans with an "error" tag holding the message.
+	if span.Status != nil && span.Status.Code == statusCodeError {
+		message := span.Status.Message
+		if message == "" {
+			message = "error"
+		}
+		result.Tags = append(result.Tags, model.StringTag("error", message))
+	}
+	return result, nil
+}
+
+// SpansFromRequest converts the spans in an export request to Zipkin spans.
+func SpansFromRequest(request *ExportTraceServiceRequest) ([]*zipkincore.Span, error) {
+	var result []*zipkincore.Span
+	for _, resourceSpans := range request.ResourceSpans {
+		local := resourceEndpoint(resourceSpans.Resource)
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				s, err := toSpan(local, span)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, model.ToZipkin(s))
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,100 @@
+package otlp
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Appender stores the spans exported.
+type Appender interface {
+	Append(*zipkincore.Span) error
+}
+
+// SpansFromProtobuf decodes an ExportTraceServiceRequest, as POSTed to
+// /v1/traces.
+func SpansFromProtobuf(r io.Reader) ([]*zipkincore.Span, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var request ExportTraceServiceRequest
+	if err := proto.Unmarshal(buf, &request); err != nil {
+		return nil, err
+	}
+	return SpansFromRequest(&request)
+}
+
+// TraceService implements OTLP's TraceService, appending the spans exported.
+type TraceService struct {
+	appender Appender
+}
+
+// NewTraceService makes a new TraceService.
+func NewTraceService(appender Appender) *TraceService {
+	return &TraceService{appender: appender}
+}
+
+// Export implements TraceService.
+func (s *TraceService) Export(ctx context.Context, request *ExportTraceServiceRequest) (*ExportTraceServiceResponse, error) {
+	spans, err := SpansFromRequest(request)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	for _, span := range spans {
+		if err := s.appender.Append(span); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "%v", err)
+		}
+	}
+	return &ExportTraceServiceResponse{}, nil
+}
+
+// traceServiceServer is the interface gRPC would generate for TraceService.
+type traceServiceServer interface {
+	Export(context.Context, *ExportTraceServiceRequest) (*ExportTraceServiceResponse, error)
+}
+
+// ExportMethod is the full gRPC method name clients call.
+const ExportMethod = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+
+func exportHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	request := new(ExportTraceServiceRequest)
+	if err := dec(request); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(traceServiceServer).Export(ctx, request)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ExportMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(traceServiceServer).Export(ctx, req.(*ExportTraceServiceRequest))
+	}
+	return interceptor(ctx, request, info, handler)
+}
+
+var traceServiceDesc = grpc.ServiceDesc{
+	ServiceName: "opentelemetry.proto.collector.trace.v1.TraceService",
+	HandlerType: (*traceServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Export",
+			Handler:    exportHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "opentelemetry/proto/collector/trace/v1/trace_service.proto",
+}
+
+// RegisterTraceService registers s with a gRPC server.
+func RegisterTraceService(server *grpc.Server, s *TraceService) {
+	server.RegisterService(&traceServiceDesc, s)
+}
@@ -0,0 +1,119 @@
+package otlp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks-experiments/loki/pkg/appendertest"
+)
+
+func stringValue(s string) *AnyValue { return &AnyValue{StringValue: &s} }
+func intValue(i int64) *AnyValue     { return &AnyValue{IntValue: &i} }
+
+func newTestRequest() *ExportTraceServiceRequest {
+	return &ExportTraceServiceRequest{
+		ResourceSpans: []*ResourceSpans{{
+			Resource: &Resource{Attributes: []*KeyValue{
+				{Key: "service.name", Value: stringValue("frontend")},
+				{Key: "net.host.ip", Value: stringValue("10.0.0.1")},
+			}},
+			ScopeSpans: []*ScopeSpans{{
+				Spans: []*Span{{
+					TraceID:           []byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 1},
+					SpanID:            []byte{0, 0, 0, 0, 0, 0, 0, 4},
+					ParentSpanID:      []byte{0, 0, 0, 0, 0, 0, 0, 3},
+					Name:              "get",
+					Kind:              spanKindClient,
+					StartTimeUnixNano: 1000000,
+					EndTimeUnixNano:   1010500,
+					Attributes: []*KeyValue{
+						{Key: "peer.service", Value: stringValue("backend")},
+						{Key: "http.status_code", Value: intValue(500)},
+						{Key: "http.url", Value: stringValue("/")},
+					},
+					Events: []*Event{{TimeUnixNano: 1005000, Name: "retry"}},
+					Status: &Status{Code: statusCodeError, Message: "boom"},
+				}},
+			}},
+		}},
+	}
+}
+
+func TestExport(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	appender := &appendertest.Appender{}
+	RegisterTraceService(server, NewTraceService(appender))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := grpc.Invoke(context.Background(), ExportMethod, newTestRequest(), &ExportTraceServiceResponse{}, conn); err != nil {
+		t.Fatal(err)
+	}
+
+	local := zipkincore.NewEndpoint()
+	local.ServiceName = "frontend"
+	local.Ipv4 = 10<<24 | 1
+	remote := zipkincore.NewEndpoint()
+	remote.ServiceName = "backend"
+	traceIDHigh, parentID, timestamp, duration := int64(2), int64(3), int64(1000), int64(11)
+	want := []*zipkincore.Span{{
+		TraceID:     1,
+		TraceIDHigh: &traceIDHigh,
+		ID:          4,
+		ParentID:    &parentID,
+		Name:        "get",
+		Timestamp:   &timestamp,
+		Duration:    &duration,
+		Annotations: []*zipkincore.Annotation{
+			{Timestamp: 1000, Value: zipkincore.CLIENT_SEND, Host: local},
+			{Timestamp: 1011, Value: zipkincore.CLIENT_RECV, Host: local},
+			{Timestamp: 1005, Value: "retry", Host: local},
+		},
+		BinaryAnnotations: []*zipkincore.BinaryAnnotation{
+			{Key: "http.status_code", Value: []byte{0, 0, 0, 0, 0, 0, 1, 0xf4}, AnnotationType: zipkincore.AnnotationType_I64, Host: local},
+			{Key: "http.url", Value: []byte("/"), AnnotationType: zipkincore.AnnotationType_STRING, Host: local},
+			{Key: "error", Value: []byte("boom"), AnnotationType: zipkincore.AnnotationType_STRING, Host: local},
+			{Key: zipkincore.SERVER_ADDR, Value: []byte{1}, AnnotationType: zipkincore.AnnotationType_BOOL, Host: remote},
+		},
+	}}
+	if have := appender.Spans(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+}
+
+func TestDecoding(t *testing.T) {
+	request := newTestRequest()
+	request.ResourceSpans[0].ScopeSpans[0].Spans[0].SpanID = []byte{1, 2, 3}
+	if _, err := SpansFromRequest(request); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// Unknown fields, like the instrumentation scope, are skipped.
+	buf, err := proto.Marshal(newTestRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = append(buf, 0x0a, 0x04, 0x1a, 0x02, 'v', '1')
+	var decoded ExportTraceServiceRequest
+	if err := proto.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.ResourceSpans) != 2 {
+		t.Fatalf("have %v", decoded.ResourceSpans)
+	}
+}
@@ -5,13 +5,12 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
 	"github.com/prometheus/common/model"
-	"github.com/prometheus/prometheus/config"
-	"github.com/prometheus/prometheus/retrieval"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"golang.org/x/net/context/ctxhttp"
@@ -19,37 +18,53 @@ import (
 	client "github.com/weaveworks-experiments/loki/pkg/client"
 )
 
+// Appender is where scraped spans go.
 type Appender interface {
 	Append(*zipkincore.Span) error
 }
 
-func NewScraperFn(appender Appender) retrieval.ScraperFn {
-	return func(target *retrieval.Target, client *http.Client, _ model.LabelSet, cfg *config.ScrapeConfig) retrieval.Scraper {
-		return &scraper{
-			appender: appender,
-			target:   target,
-			cfg:      cfg,
-			client:   client,
-		}
+// Target is the part of a Prometheus target a scraper needs.  Retrieval's
+// own types aren't used, so this package can be tested without them.
+type Target interface {
+	URL() *url.URL
+	Labels() model.LabelSet
+}
+
+// New makes a scraper appending the spans it scrapes from target.  id
+// identifies this Loki to its targets, which hold spans until every Loki
+// scraping them has acknowledged them; it must be unique among replicas, and
+// stable across restarts.
+func New(appender Appender, id string, target Target, client *http.Client) *Scraper {
+	return &Scraper{
+		appender: appender,
+		target:   target,
+		client:   client,
+		id:       id,
 	}
 }
 
-type scraper struct {
+// Scraper scrapes spans from a target, implementing retrieval.Scraper.
+type Scraper struct {
 	appender Appender
-	target   *retrieval.Target
-	cfg      *config.ScrapeConfig
+	target   Target
 	client   *http.Client
+	id       string
+
+	// cursor is that of the last batch appended, to be acknowledged by the
+	// next scrape.  Until then the target holds on to the batch, so a failed
+	// scrape loses nothing; the batch is just sent again.
+	cursor uint64
 }
 
-func (s *scraper) NeedsThrottling() bool {
+func (s *Scraper) NeedsThrottling() bool {
 	return false
 }
 
-func (s *scraper) Offset(interval time.Duration) time.Duration {
+func (s *Scraper) Offset(interval time.Duration) time.Duration {
 	return interval
 }
 
-func (s *scraper) Scrape(ctx context.Context) error {
+func (s *Scraper) Scrape(ctx context.Context) error {
 	if err := s.scrape(ctx); err != nil {
 		log.Errorf("Error scraping %s: %v", s.target.URL().String(), err)
 		return err
@@ -57,12 +72,17 @@ func (s *scraper) Scrape(ctx context.Context) error {
 	return nil
 }
 
-func (s *scraper) scrape(ctx context.Context) error {
-	req, err := http.NewRequest("GET", s.target.URL().String(), nil)
+func (s *Scraper) scrape(ctx context.Context) error {
+	u := s.target.URL()
+	params := u.Query()
+	params.Set(client.AckParam, strconv.FormatUint(s.cursor, 10))
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
 		log.Errorf("1: %v", err)
 		return err
 	}
+	req.Header.Set(client.ScraperIDHeader, s.id)
 
 	resp, err := ctxhttp.Do(ctx, s.client, req)
 	if err != nil {
@@ -110,5 +130,12 @@ func (s *scraper) scrape(ctx context.Context) error {
 			return err
 		}
 	}
+
+	// Targets which predate acknowledgements send no cursor.
+	if cursor := resp.Header.Get(client.CursorHeader); cursor != "" {
+		if s.cursor, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return fmt.Errorf("invalid cursor %q: %v", cursor, err)
+		}
+	}
 	return nil
 }
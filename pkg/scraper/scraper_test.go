@@ -0,0 +1,125 @@
+package scraper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks-experiments/loki/pkg/appendertest"
+	client "github.com/weaveworks-experiments/loki/pkg/client"
+)
+
+type testTarget struct {
+	url    *url.URL
+	labels model.LabelSet
+}
+
+func newTestTarget(t *testing.T, rawurl string) testTarget {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testTarget{
+		url:    u,
+		labels: model.LabelSet{model.JobLabel: "frontend", model.InstanceLabel: model.LabelValue(u.Host)},
+	}
+}
+
+func (t testTarget) URL() *url.URL {
+	u := *t.url
+	return &u
+}
+
+func (t testTarget) Labels() model.LabelSet {
+	return t.labels
+}
+
+func newTestSpan(traceID int64) *zipkincore.Span {
+	span := zipkincore.NewSpan()
+	span.TraceID = traceID
+	span.Annotations = []*zipkincore.Annotation{{Timestamp: 1000, Value: zipkincore.SERVER_RECV}}
+	span.BinaryAnnotations = []*zipkincore.BinaryAnnotation{}
+	return span
+}
+
+func TestScrapeAcknowledges(t *testing.T) {
+	collector := client.NewCollector(10)
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	appender := &appendertest.Appender{}
+	s := New(appender, "loki", newTestTarget(t, server.URL), http.DefaultClient)
+
+	if err := collector.Collect(newTestSpan(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Scrape(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []int64{1}, appender.TraceIDs(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+	if host := appender.Spans()[0].Annotations[0].Host; host.GetServiceName() != "frontend" {
+		t.Fatalf("expected spans from the job's service, got %v", host)
+	}
+
+	// A batch which isn't appended isn't acknowledged, so is sent again.
+	if err := collector.Collect(newTestSpan(2)); err != nil {
+		t.Fatal(err)
+	}
+	appender.Failures = 1
+	if err := s.Scrape(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := collector.Collect(newTestSpan(3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Scrape(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []int64{1, 2, 3}, appender.TraceIDs(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+
+	// Once acknowledged, nothing is sent again.
+	if err := s.Scrape(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []int64{1, 2, 3}, appender.TraceIDs(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+}
+
+func TestScrapeWithoutCursor(t *testing.T) {
+	// Targets which predate acknowledgements send no cursor, and send each
+	// span once whatever is acknowledged.
+	var acks []string
+	spans := []*zipkincore.Span{newTestSpan(1)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acks = append(acks, r.URL.Query().Get(client.AckParam))
+		if err := client.WriteSpans(spans, w); err != nil {
+			t.Error(err)
+		}
+		spans = []*zipkincore.Span{}
+	}))
+	defer server.Close()
+	appender := &appendertest.Appender{}
+	s := New(appender, "loki", newTestTarget(t, server.URL), http.DefaultClient)
+
+	for i := 0; i < 2; i++ {
+		if err := s.Scrape(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, have := []int64{1}, appender.TraceIDs(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+	if want, have := []string{"0", "0"}, acks; !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+}
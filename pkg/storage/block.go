@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"os"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
+)
+
+// block is an unchanging set of traces, either held in memory or on disk.
+type block interface {
+	ReadStore
+
+	// allTraces returns every trace in the block, sorted by MinTimestamp.
+	allTraces() ([]Trace, error)
+
+	numTraces() int
+
+	// bounds returns the earliest MinTimestamp and the latest MaxTimestamp of
+	// the traces in the block, in microseconds.
+	bounds() (from, through int64)
+
+	// ids returns the IDs of all the traces in the block.
+	ids() []model.TraceID
+
+	// expire returns a block without the traces which finished before
+	// cutoffUS, or nil if there would be none left.
+	expire(cutoffUS int64) (block, error)
+
+	Close() error
+}
+
+// dropBlock releases the resources held by a block, deleting its file if it
+// has one.
+func dropBlock(b block) error {
+	if err := b.Close(); err != nil {
+		return err
+	}
+	if d, ok := b.(*diskBlock); ok {
+		return os.Remove(d.path)
+	}
+	return nil
+}
+
+// overlaps returns whether a block could hold traces matching the query.
+func overlaps(b block, query Query) bool {
+	from, through := b.bounds()
+	return through >= query.StartMS*1000 && from <= query.EndMS*1000
+}
@@ -2,17 +2,36 @@ package storage
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/apache/thrift/lib/go/thrift"
 	"github.com/boltdb/bolt"
 	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sburnett/lexicographic-tuples"
-	"github.com/willf/bloom"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
 )
 
 const (
 	expectedNumServices  = 1000
 	expectedNumSpanNames = 100
+
+	// How often to roll up dependency links, and how long to wait after the
+	// end of a period before doing so, so late spans are included.
+	dependencyRollupInterval = time.Minute
+	dependencyRollupDelay    = 10 * time.Minute
+
+	// The layout of the keys, recorded so later layouts can be told apart.
+	boltDBSchemaVersion = 1
+
+	// How many traces retention deletes in each write transaction.
+	defaultExpireBatchSize = 1000
 )
 
 var (
@@ -20,44 +39,196 @@ var (
 	servicesBucket     = []byte("services")
 	spanNamesBucket    = []byte("span_names")
 	serviceIndexBucket = []byte("service_index")
+	tagIndexBucket     = []byte("tag_index")
+	dependenciesBucket = []byte("dependencies")
+	metaBucket         = []byte("meta")
+
+	servicesFilterCapacityKey  = []byte("services_filter_capacity")
+	spanNamesFilterCapacityKey = []byte("span_names_filter_capacity")
+	dependenciesThroughKey     = []byte("dependencies_through")
+	schemaVersionKey           = []byte("schema_version")
+)
+
+var (
+	filterEntriesDesc = prometheus.NewDesc(
+		"loki_boltdb_filter_entries",
+		"Number of entries in the BoltDB index bloom filters.",
+		[]string{"filter"}, nil,
+	)
+	filterCapacityDesc = prometheus.NewDesc(
+		"loki_boltdb_filter_capacity",
+		"Number of entries the BoltDB index bloom filters are sized for.",
+		[]string{"filter"}, nil,
+	)
+	filterResizesDesc = prometheus.NewDesc(
+		"loki_boltdb_filter_resizes_total",
+		"Number of times the BoltDB index bloom filters have been resized.",
+		[]string{"filter"}, nil,
+	)
+	filterFalsePositiveRateDesc = prometheus.NewDesc(
+		"loki_boltdb_filter_false_positive_rate",
+		"Estimated false positive rate of the BoltDB index bloom filters.",
+		[]string{"filter"}, nil,
+	)
 )
 
 type boltDBStorage struct {
 	db *bolt.DB
 
-	servicesFilter, spanNameFilter *bloom.BloomFilter
+	// mtx serialises Appends and protects the filters, which are only
+	// updated once the transaction that wrote their keys has committed.
+	mtx                            sync.Mutex
+	servicesFilter, spanNameFilter *indexFilter
+
+	expireBatchSize  int
+	retainer, rollup *loop
+}
+
+// NewBoltDBSpanStore opens (or creates) a BoltDB-backed SpanStore at path,
+// which drops traces older than retention.  Dependency links are rolled up in
+// the background, and kept after the traces are dropped.
+func NewBoltDBSpanStore(path string, retention time.Duration) (SpanStore, error) {
+	s, err := newBoltDBStorage(path)
+	if err != nil {
+		return nil, err
+	}
+	s.retainer = newRetainer(retention, s.expire)
+	s.rollup = startLoop(dependencyRollupInterval, func() {
+		if err := s.rollUpDependencies(time.Now()); err != nil {
+			log.Errorf("Error rolling up dependencies: %v", err)
+		}
+	})
+	return s, nil
 }
 
-func newBoltDBStorage() (*boltDBStorage, error) {
-	db, err := bolt.Open("traces.db", 0666, &bolt.Options{})
+func newBoltDBStorage(path string) (*boltDBStorage, error) {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: time.Second})
 	if err != nil {
 		return nil, err
 	}
 
+	s := &boltDBStorage{
+		db:              db,
+		expireBatchSize: defaultExpireBatchSize,
+		retainer:        newRetainer(0, nil),
+		rollup:          startLoop(0, nil),
+	}
 	if err := db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists(tracesBucket); err != nil {
-			return err
+		for _, bucket := range [][]byte{tracesBucket, servicesBucket, spanNamesBucket, serviceIndexBucket, tagIndexBucket, dependenciesBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
 		}
-		if _, err := tx.CreateBucketIfNotExists(servicesBucket); err != nil {
+		if err := checkSchema(tx); err != nil {
 			return err
 		}
-		if _, err := tx.CreateBucketIfNotExists(spanNamesBucket); err != nil {
+
+		// Warm the filters from the indexes, so we don't rewrite every
+		// entry after a restart.
+		s.servicesFilter, err = loadIndexFilter(tx, servicesBucket, servicesFilterCapacityKey, expectedNumServices)
+		if err != nil {
 			return err
 		}
-		if _, err := tx.CreateBucketIfNotExists(serviceIndexBucket); err != nil {
-			return err
+		s.spanNameFilter, err = loadIndexFilter(tx, spanNamesBucket, spanNamesFilterCapacityKey, expectedNumServices*expectedNumSpanNames)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadIndexFilter builds a filter containing every key in bucket, sized
+// according to the capacity persisted under capacityKey in the meta bucket.
+func loadIndexFilter(tx *bolt.Tx, bucket, capacityKey []byte, defaultCapacity uint) (*indexFilter, error) {
+	capacity := defaultCapacity
+	if v := tx.Bucket(metaBucket).Get(capacityKey); v != nil {
+		var persisted int64
+		if _, err := lex.Decode(v, &persisted); err != nil {
+			return nil, err
 		}
+		capacity = uint(persisted)
+	}
+
+	b := tx.Bucket(bucket)
+	if entries := uint(b.Stats().KeyN); entries > capacity {
+		capacity = 2 * entries
+	}
+
+	filter := newIndexFilter(capacity)
+	if err := b.ForEach(func(k, _ []byte) error {
+		filter.add(k)
 		return nil
 	}); err != nil {
-		db.Close()
 		return nil, err
 	}
+	return filter, persistFilterCapacity(tx, capacityKey, filter)
+}
 
-	return &boltDBStorage{
-		db:             db,
-		servicesFilter: bloom.New(expectedNumServices, 5),
-		spanNameFilter: bloom.New(expectedNumServices*expectedNumSpanNames, 5),
-	}, nil
+func persistFilterCapacity(tx *bolt.Tx, capacityKey []byte, filter *indexFilter) error {
+	v, err := lex.Encode(int64(filter.capacity))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(metaBucket).Put(capacityKey, v)
+}
+
+// checkSchema records the schema version in a new database, and refuses to
+// open one written with a different version.
+func checkSchema(tx *bolt.Tx) error {
+	meta := tx.Bucket(metaBucket)
+	if v := meta.Get(schemaVersionKey); v != nil {
+		var version int64
+		if _, err := lex.Decode(v, &version); err != nil {
+			return err
+		}
+		if version != boltDBSchemaVersion {
+			return fmt.Errorf("unknown schema version %d", version)
+		}
+		return nil
+	}
+	v, err := lex.Encode(int64(boltDBSchemaVersion))
+	if err != nil {
+		return err
+	}
+	return meta.Put(schemaVersionKey, v)
+}
+
+// resizeFilter rebuilds a saturated filter with double its current entries.
+func (s *boltDBStorage) resizeFilter(bucket, capacityKey []byte, filter *indexFilter) (*indexFilter, error) {
+	result, err := s.buildFilter(bucket, capacityKey, 2*filter.entries, filter.resizes+1)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Resized %s filter to %d entries", bucket, result.capacity)
+	return result, nil
+}
+
+// rebuildFilter rebuilds a stale filter at its current capacity, dropping the
+// keys removed from the index.  It doesn't count as a resize.
+func (s *boltDBStorage) rebuildFilter(bucket, capacityKey []byte, filter *indexFilter) (*indexFilter, error) {
+	result, err := s.buildFilter(bucket, capacityKey, filter.capacity, filter.resizes)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Rebuilt %s filter without %d removed entries", bucket, len(filter.removed))
+	return result, nil
+}
+
+func (s *boltDBStorage) buildFilter(bucket, capacityKey []byte, capacity, resizes uint) (*indexFilter, error) {
+	var result *indexFilter
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		result = newIndexFilter(capacity)
+		result.resizes = resizes
+		if err := tx.Bucket(bucket).ForEach(func(k, _ []byte) error {
+			result.add(k)
+			return nil
+		}); err != nil {
+			return err
+		}
+		return persistFilterCapacity(tx, capacityKey, result)
+	})
+	return result, err
 }
 
 func encodeSpan(span *zipkincore.Span) ([]byte, error) {
@@ -83,13 +254,20 @@ func decodeSpan(buf []byte) (*zipkincore.Span, error) {
 	return span, nil
 }
 
+// services returns the services a span's annotations were recorded by.
+// Annotations without a host, which can come from spans pushed to us, are
+// ignored.
 func services(span *zipkincore.Span) []string {
 	services := map[string]struct{}{}
 	for _, annotation := range span.Annotations {
-		services[annotation.Host.ServiceName] = struct{}{}
+		if annotation.IsSetHost() {
+			services[annotation.Host.ServiceName] = struct{}{}
+		}
 	}
 	for _, annotation := range span.BinaryAnnotations {
-		services[annotation.Host.ServiceName] = struct{}{}
+		if annotation.IsSetHost() {
+			services[annotation.Host.ServiceName] = struct{}{}
+		}
 	}
 	result := make([]string, 0, len(services))
 	for service := range services {
@@ -98,25 +276,61 @@ func services(span *zipkincore.Span) []string {
 	return result
 }
 
+// serviceIndexKeys returns the service index keys for a span, which are
+// (service, timestamp, traceID) for each of the span's services.
+func serviceIndexKeys(span *zipkincore.Span) ([][]byte, error) {
+	var keys [][]byte
+	traceID := model.ZipkinTraceID(span)
+	for _, service := range services(span) {
+		key, err := lex.Encode(service, span.GetTimestamp(), traceID.High, traceID.Low)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// tagIndexKeys returns the tag index keys for a span, which are (service,
+// term, timestamp, traceID) for each of the span's services and terms.
+func tagIndexKeys(span *zipkincore.Span) ([][]byte, error) {
+	var keys [][]byte
+	traceID := model.ZipkinTraceID(span)
+	for _, service := range services(span) {
+		for _, term := range spanTerms(span) {
+			key, err := lex.Encode(service, term, span.GetTimestamp(), traceID.High, traceID.Low)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
 func (s *boltDBStorage) Append(span *zipkincore.Span) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var newServices, newSpanNames [][]byte
+	if err := s.db.Update(func(tx *bolt.Tx) error {
 		var (
-			traceID       = span.GetTraceID()
+			traceID       = model.ZipkinTraceID(span)
 			spanTimestamp = span.GetTimestamp()
 			spanID        = span.GetID()
 			services      = services(span)
 		)
-		spanKey, err := lex.Encode(traceID, spanTimestamp, spanID)
+		spanKey, err := lex.Encode(traceID.High, traceID.Low, spanTimestamp, spanID)
 		if err != nil {
 			return err
 		}
-		traceKeys := [][]byte{}
-		for _, service := range services {
-			key, err := lex.Encode(service, spanTimestamp, traceID)
-			if err != nil {
-				return err
-			}
-			traceKeys = append(traceKeys, key)
+		traceKeys, err := serviceIndexKeys(span)
+		if err != nil {
+			return err
+		}
+		tagKeys, err := tagIndexKeys(span)
+		if err != nil {
+			return err
 		}
 		spanBytes, err := encodeSpan(span)
 		if err != nil {
@@ -128,13 +342,13 @@ func (s *boltDBStorage) Append(span *zipkincore.Span) error {
 			b := tx.Bucket(servicesBucket)
 			for _, service := range services {
 				serviceBytes := []byte(service)
-				if s.servicesFilter.Test(serviceBytes) {
+				if s.servicesFilter.test(serviceBytes) {
 					continue
 				}
 				if err := b.Put(serviceBytes, nil); err != nil {
 					return err
 				}
-				s.servicesFilter.Add(serviceBytes)
+				newServices = append(newServices, serviceBytes)
 			}
 		}
 
@@ -146,13 +360,13 @@ func (s *boltDBStorage) Append(span *zipkincore.Span) error {
 				if err != nil {
 					return err
 				}
-				if s.spanNameFilter.Test(spanNameBytes) {
+				if s.spanNameFilter.test(spanNameBytes) {
 					continue
 				}
 				if err := b.Put(spanNameBytes, nil); err != nil {
 					return err
 				}
-				s.spanNameFilter.Add(spanNameBytes)
+				newSpanNames = append(newSpanNames, spanNameBytes)
 			}
 		}
 
@@ -173,8 +387,346 @@ func (s *boltDBStorage) Append(span *zipkincore.Span) error {
 				}
 			}
 		}
+
+		// And in the tag index
+		{
+			b := tx.Bucket(tagIndexBucket)
+			for _, tagKey := range tagKeys {
+				if err := b.Put(tagKey, nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Only now the transaction has committed is it safe to update the filters.
+	for _, key := range newServices {
+		s.servicesFilter.add(key)
+	}
+	for _, key := range newSpanNames {
+		s.spanNameFilter.add(key)
+	}
+
+	var err error
+	if s.servicesFilter.saturated() {
+		if s.servicesFilter, err = s.resizeFilter(servicesBucket, servicesFilterCapacityKey, s.servicesFilter); err != nil {
+			return err
+		}
+	}
+	if s.spanNameFilter.saturated() {
+		if s.spanNameFilter, err = s.resizeFilter(spanNamesBucket, spanNamesFilterCapacityKey, s.spanNameFilter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FilterStats returns statistics for the services and span names filters.
+func (s *boltDBStorage) FilterStats() map[string]FilterStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return map[string]FilterStats{
+		"services":   s.servicesFilter.stats(),
+		"span_names": s.spanNameFilter.stats(),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (s *boltDBStorage) Describe(ch chan<- *prometheus.Desc) {
+	ch <- filterEntriesDesc
+	ch <- filterCapacityDesc
+	ch <- filterResizesDesc
+	ch <- filterFalsePositiveRateDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *boltDBStorage) Collect(ch chan<- prometheus.Metric) {
+	for name, stats := range s.FilterStats() {
+		ch <- prometheus.MustNewConstMetric(filterEntriesDesc, prometheus.GaugeValue, float64(stats.Entries), name)
+		ch <- prometheus.MustNewConstMetric(filterCapacityDesc, prometheus.GaugeValue, float64(stats.Capacity), name)
+		ch <- prometheus.MustNewConstMetric(filterResizesDesc, prometheus.CounterValue, float64(stats.Resizes), name)
+		ch <- prometheus.MustNewConstMetric(filterFalsePositiveRateDesc, prometheus.GaugeValue, stats.EstimatedFalsePositiveRate, name)
+	}
+}
+
+func (s *boltDBStorage) Close() error {
+	s.retainer.Stop()
+	s.rollup.Stop()
+	return s.db.Close()
+}
+
+// expire deletes traces whose latest span started before cutoffUS, along
+// with their index entries.  Traces are found by walking the traces bucket,
+// so spans without a host, which aren't in the service index, expire too.
+// Services and span names which no longer have any spans are removed, and
+// forgotten by the filters, which are rebuilt once many have been.
+//
+// The walk is done in read-only transactions without the store lock, and the
+// traces it finds deleted in batches of expireBatchSize, so Appends are only
+// held up for one batch at a time.
+func (s *boltDBStorage) expire(cutoffUS int64) error {
+	var (
+		from    []byte
+		deleted int
+	)
+	for {
+		traceIDs, next, err := s.expiredTraces(from, cutoffUS)
+		if err != nil {
+			return err
+		}
+		if len(traceIDs) > 0 {
+			n, err := s.expireTraces(traceIDs, cutoffUS)
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+		if next == nil {
+			break
+		}
+		from = next
+	}
+	if deleted > 0 {
+		log.Infof("Retention deleted %d traces", deleted)
+	}
+	return nil
+}
+
+// expiredTraces walks the traces bucket from the key from, returning up to
+// expireBatchSize traces whose latest span started before cutoffUS, and the
+// key to carry on from, or nil once the walk is done.
+func (s *boltDBStorage) expiredTraces(from []byte, cutoffUS int64) ([]model.TraceID, []byte, error) {
+	var (
+		traceIDs []model.TraceID
+		next     []byte
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Spans are keyed by (traceID, timestamp, spanID), so all the spans
+		// for a given trace are adjacent.
+		var (
+			current model.TraceID
+			started bool
+			latest  int64
+		)
+		c := tx.Bucket(tracesBucket).Cursor()
+		k, _ := c.First()
+		if from != nil {
+			k, _ = c.Seek(from)
+		}
+		for ; k != nil; k, _ = c.Next() {
+			var traceID model.TraceID
+			var timestamp int64
+			if _, err := lex.Decode(k, &traceID.High, &traceID.Low, &timestamp); err != nil {
+				return err
+			}
+			if started && traceID != current {
+				if latest < cutoffUS {
+					traceIDs = append(traceIDs, current)
+				}
+				if len(traceIDs) >= s.expireBatchSize {
+					next = append([]byte{}, k...)
+					return nil
+				}
+				started = false
+			}
+			if !started {
+				current, latest, started = traceID, timestamp, true
+			}
+			latest = max(latest, timestamp)
+		}
+		if started && latest < cutoffUS {
+			traceIDs = append(traceIDs, current)
+		}
+		return nil
+	})
+	return traceIDs, next, err
+}
+
+// expireTraces deletes those of traceIDs which still haven't had a span since
+// cutoffUS, returning how many were deleted.
+func (s *boltDBStorage) expireTraces(traceIDs []model.TraceID, cutoffUS int64) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var deleted int
+	var removedServices, removedSpanNames [][]byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var spanKeys, indexKeys, tagKeys [][]byte
+		affectedServices := map[string]struct{}{}
+		c := tx.Bucket(tracesBucket).Cursor()
+
+		// Spans may have been added since the walk found the trace, so check
+		// it has still expired before collecting the keys for its spans, and
+		// their index entries.
+		for _, traceID := range traceIDs {
+			prefix, err := lex.Encode(traceID.High, traceID.Low)
+			if err != nil {
+				return err
+			}
+			var traceKeys [][]byte
+			var spans []*zipkincore.Span
+			expired := true
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				var high, low uint64
+				var timestamp int64
+				if _, err := lex.Decode(k, &high, &low, &timestamp); err != nil {
+					return err
+				}
+				if timestamp >= cutoffUS {
+					expired = false
+					break
+				}
+				span, err := decodeSpan(v)
+				if err != nil {
+					return err
+				}
+				traceKeys = append(traceKeys, append([]byte{}, k...))
+				spans = append(spans, span)
+			}
+			if !expired || len(traceKeys) == 0 {
+				continue
+			}
+
+			deleted++
+			for _, span := range spans {
+				entries, err := serviceIndexKeys(span)
+				if err != nil {
+					return err
+				}
+				indexKeys = append(indexKeys, entries...)
+				if entries, err = tagIndexKeys(span); err != nil {
+					return err
+				}
+				tagKeys = append(tagKeys, entries...)
+				for _, service := range services(span) {
+					affectedServices[service] = struct{}{}
+				}
+			}
+			spanKeys = append(spanKeys, traceKeys...)
+		}
+
+		for _, bk := range []struct {
+			bucket []byte
+			keys   [][]byte
+		}{
+			{tracesBucket, spanKeys},
+			{serviceIndexBucket, indexKeys},
+			{tagIndexBucket, tagKeys},
+		} {
+			if err := deleteKeys(tx.Bucket(bk.bucket), bk.keys); err != nil {
+				return err
+			}
+		}
+
+		// Finally fix up the services and span names for affected services.
+		for service := range affectedServices {
+			services, spanNames, err := reindexService(tx, service)
+			if err != nil {
+				return err
+			}
+			removedServices = append(removedServices, services...)
+			removedSpanNames = append(removedSpanNames, spanNames...)
+		}
 		return nil
 	})
+	if err != nil || deleted == 0 {
+		return deleted, err
+	}
+
+	// Only now the transaction has committed is it safe to update the filters.
+	for _, key := range removedServices {
+		s.servicesFilter.remove(key)
+	}
+	for _, key := range removedSpanNames {
+		s.spanNameFilter.remove(key)
+	}
+	if s.servicesFilter.stale() {
+		if s.servicesFilter, err = s.rebuildFilter(servicesBucket, servicesFilterCapacityKey, s.servicesFilter); err != nil {
+			return deleted, err
+		}
+	}
+	if s.spanNameFilter.stale() {
+		if s.spanNameFilter, err = s.rebuildFilter(spanNamesBucket, spanNamesFilterCapacityKey, s.spanNameFilter); err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// reindexService rebuilds the services and span_names entries for a service
+// from the spans that remain in the store, returning copies of the keys
+// removed from each.
+func reindexService(tx *bolt.Tx, service string) ([][]byte, [][]byte, error) {
+	prefix, err := lex.Encode(service)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spanNames := map[string]struct{}{}
+	c := tx.Bucket(serviceIndexBucket).Cursor()
+	seen := map[model.TraceID]struct{}{}
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		var serviceName string
+		var timestamp int64
+		var traceID model.TraceID
+		if _, err := lex.Decode(k, &serviceName, &timestamp, &traceID.High, &traceID.Low); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := seen[traceID]; ok {
+			continue
+		}
+		seen[traceID] = struct{}{}
+
+		trace, err := readTrace(tx, traceID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if trace == nil {
+			continue
+		}
+		for _, span := range trace.Spans {
+			for _, spanService := range services(span) {
+				if spanService == service {
+					spanNames[span.Name] = struct{}{}
+				}
+			}
+		}
+	}
+
+	var removedServices [][]byte
+	if len(seen) == 0 {
+		if err := tx.Bucket(servicesBucket).Delete([]byte(service)); err != nil {
+			return nil, nil, err
+		}
+		removedServices = append(removedServices, []byte(service))
+	}
+
+	var staleKeys [][]byte
+	c = tx.Bucket(spanNamesBucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		var serviceName, spanName string
+		if _, err := lex.Decode(k, &serviceName, &spanName); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := spanNames[spanName]; !ok {
+			staleKeys = append(staleKeys, append([]byte{}, k...))
+		}
+	}
+	return removedServices, staleKeys, deleteKeys(tx.Bucket(spanNamesBucket), staleKeys)
+}
+
+// deleteKeys deletes keys from a bucket.  Deleting whilst iterating with a
+// cursor skips entries, hence collecting them first.
+func deleteKeys(b *bolt.Bucket, keys [][]byte) error {
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *boltDBStorage) Services() ([]string, error) {
@@ -192,8 +744,11 @@ func (s *boltDBStorage) Services() ([]string, error) {
 func (s *boltDBStorage) SpanNames(serviceName string) ([]string, error) {
 	var result []string
 	err := s.db.View(func(tx *bolt.Tx) error {
-		prefix := []byte(serviceName)
-		c := tx.Bucket([]byte(spanNamesBucket)).Cursor()
+		prefix, err := lex.Encode(serviceName)
+		if err != nil {
+			return err
+		}
+		c := tx.Bucket(spanNamesBucket).Cursor()
 		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
 			var serviceName, spanName string
 			if _, err := lex.Decode(k, &serviceName, &spanName); err != nil {
@@ -206,58 +761,407 @@ func (s *boltDBStorage) SpanNames(serviceName string) ([]string, error) {
 	return result, err
 }
 
-func (s *boltDBStorage) Trace(id int64) ([]*zipkincore.Span, error) {
-	var result []*zipkincore.Span
+func (s *boltDBStorage) Trace(id model.TraceID) (Trace, error) {
+	var result *Trace
 	err := s.db.View(func(tx *bolt.Tx) error {
-		prefix, err := lex.Encode(id)
+		var err error
+		result, err = readTrace(tx, id)
+		return err
+	})
+	if err != nil {
+		return Trace{}, err
+	}
+	if result == nil {
+		return Trace{}, ErrNotFound
+	}
+	return *result, nil
+}
+
+// readTrace reads all the spans for a trace, returning nil if there are none.
+func readTrace(tx *bolt.Tx, id model.TraceID) (*Trace, error) {
+	prefix, err := lex.Encode(id.High, id.Low)
+	if err != nil {
+		return nil, err
+	}
+	var result *Trace
+	c := tx.Bucket(tracesBucket).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		span, err := decodeSpan(v)
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			result = newTrace(span)
+		} else {
+			result.addSpan(span)
+		}
+	}
+	return result, nil
+}
+
+func (s *boltDBStorage) Traces(query Query) ([]Trace, error) {
+	if query.Limit <= 0 {
+		return nil, nil
+	}
+	if query.ServiceName == "" {
+		return s.scanTraces(query)
+	}
+
+	// The service index is keyed by (service, timestamp, traceID), and the tag
+	// index by (service, term, timestamp, traceID).  If the query has tags, use
+	// the tag index for the first one; the rest are checked by match.
+	bucket := serviceIndexBucket
+	prefix, err := lex.Encode(query.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	if terms := query.terms(); len(terms) > 0 {
+		bucket = tagIndexBucket
+		if prefix, err = lex.Encode(query.ServiceName, terms[0]); err != nil {
+			return nil, err
+		}
+	}
+	start, err := lex.Encode(query.StartMS * 1000)
+	if err != nil {
+		return nil, err
+	}
+	start = append(append([]byte{}, prefix...), start...)
+	end, err := lex.Encode(query.EndMS*1000 + 1)
+	if err != nil {
+		return nil, err
+	}
+	end = append(append([]byte{}, prefix...), end...)
+
+	var traces []Trace
+	err = s.db.View(func(tx *bolt.Tx) error {
+		// Walk the index backwards from the end of the window to get
+		// newest-first results, or forwards from the start for oldest-first.
+		c := tx.Bucket(bucket).Cursor()
+		var k []byte
+		next := c.Prev
+		if query.Sort == SortOldest {
+			k, _ = c.Seek(start)
+			next = c.Next
+		} else if k, _ = c.Seek(end); k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+
+		seen := map[model.TraceID]struct{}{}
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, _ = next() {
+			var timestamp int64
+			var traceID model.TraceID
+			if _, err := lex.Decode(k[len(prefix):], &timestamp, &traceID.High, &traceID.Low); err != nil {
+				return err
+			}
+			if timestamp < query.StartMS*1000 || timestamp > query.EndMS*1000 {
+				break
+			}
+			if _, ok := seen[traceID]; ok {
+				continue
+			}
+			seen[traceID] = struct{}{}
+
+			trace, err := readTrace(tx, traceID)
+			if err != nil {
+				return err
+			}
+			if trace == nil || !trace.match(query) {
+				continue
+			}
+			traces = append(traces, *trace)
+			if len(traces) >= query.candidates() {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !query.Sort.byTime() {
+		sortTraces(traces, query.Sort)
+		if len(traces) > query.Limit {
+			traces = traces[:query.Limit]
+		}
+	}
+	return traces, nil
+}
+
+// scanTraces answers queries without a service by walking every service's
+// index between StartMS and EndMS.  Only the index keys are read to order the
+// candidates, so no more traces are decoded than needed.
+func (s *boltDBStorage) scanTraces(query Query) ([]Trace, error) {
+	var traces []Trace
+	err := s.db.View(func(tx *bolt.Tx) error {
+		indexed, err := indexedTraces(tx, query.StartMS, query.EndMS+1)
 		if err != nil {
 			return err
 		}
-		c := tx.Bucket([]byte(tracesBucket)).Cursor()
-		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
-			span, err := decodeSpan(v)
+
+		// Order the candidates as a walk of a single service's index would:
+		// by their latest indexed span when newest first, and their earliest
+		// when oldest first.
+		type candidate struct {
+			id        model.TraceID
+			timestamp int64
+		}
+		candidates := make([]candidate, 0, len(indexed))
+		for id, bounds := range indexed {
+			timestamp := bounds.last
+			if query.Sort == SortOldest {
+				timestamp = bounds.first
+			}
+			candidates = append(candidates, candidate{id, timestamp})
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			a, b := candidates[i], candidates[j]
+			if query.Sort == SortOldest {
+				a, b = b, a
+			}
+			if a.timestamp != b.timestamp {
+				return a.timestamp > b.timestamp
+			}
+			return a.id.High > b.id.High || (a.id.High == b.id.High && a.id.Low > b.id.Low)
+		})
+
+		for _, c := range candidates {
+			trace, err := readTrace(tx, c.id)
 			if err != nil {
 				return err
 			}
-			result = append(result, span)
+			if trace == nil || !trace.match(query) {
+				continue
+			}
+			traces = append(traces, *trace)
+			if len(traces) >= query.candidates() {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !query.Sort.byTime() {
+		sortTraces(traces, query.Sort)
+		if len(traces) > query.Limit {
+			traces = traces[:query.Limit]
+		}
+	}
+	return traces, nil
+}
+
+// indexBounds are the earliest and latest timestamps indexed for a trace.
+type indexBounds struct {
+	first, last int64
+}
+
+// indexedTraces walks every service's index between startMS (inclusive) and
+// endMS (exclusive), returning the bounds of the timestamps found for each
+// trace.  Traces none of whose spans have a host aren't indexed.
+func indexedTraces(tx *bolt.Tx, startMS, endMS int64) (map[model.TraceID]indexBounds, error) {
+	result := map[model.TraceID]indexBounds{}
+	c := tx.Bucket(serviceIndexBucket).Cursor()
+	err := tx.Bucket(servicesBucket).ForEach(func(service, _ []byte) error {
+		prefix, err := lex.Encode(string(service))
+		if err != nil {
+			return err
+		}
+		start, err := lex.Encode(string(service), startMS*1000)
+		if err != nil {
+			return err
+		}
+		for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			var timestamp int64
+			var traceID model.TraceID
+			if _, err := lex.Decode(k[len(prefix):], &timestamp, &traceID.High, &traceID.Low); err != nil {
+				return err
+			}
+			if timestamp >= endMS*1000 {
+				break
+			}
+			bounds, ok := result[traceID]
+			if !ok || timestamp < bounds.first {
+				bounds.first = timestamp
+			}
+			if !ok || timestamp > bounds.last {
+				bounds.last = timestamp
+			}
+			result[traceID] = bounds
 		}
 		return nil
 	})
 	return result, err
 }
 
-func (s *boltDBStorage) Traces(query Query) ([][]*zipkincore.Span, error) {
-	var result [][]*zipkincore.Span
-	err := s.db.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket([]byte(tracesBucket)).Cursor()
-		var previousTraceID int64
-		var numTraces int
-		var currentTrace []*zipkincore.Span
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			var traceID, timestamp, spanID int64
-			if _, err := lex.Decode(k, &traceID, &timestamp, &spanID); err != nil {
+// tracesStarting calls f with every trace which started between startMS
+// (inclusive) and endMS (exclusive), found using the service index.
+func tracesStarting(tx *bolt.Tx, startMS, endMS int64, f func(*Trace)) error {
+	indexed, err := indexedTraces(tx, startMS, endMS)
+	if err != nil {
+		return err
+	}
+	for traceID := range indexed {
+		trace, err := readTrace(tx, traceID)
+		if err != nil {
+			return err
+		}
+		if trace != nil && trace.MinTimestamp >= startMS*1000 && trace.MinTimestamp < endMS*1000 {
+			f(trace)
+		}
+	}
+	return nil
+}
+
+// dependenciesThrough returns the end of the last period rolled up, or 0 if
+// none have been.
+func dependenciesThrough(tx *bolt.Tx) (int64, error) {
+	var through int64
+	if v := tx.Bucket(metaBucket).Get(dependenciesThroughKey); v != nil {
+		if _, err := lex.Decode(v, &through); err != nil {
+			return 0, err
+		}
+	}
+	return through, nil
+}
+
+// firstTimestampMS returns the earliest span timestamp in the service index
+// at or after fromMS.
+func firstTimestampMS(tx *bolt.Tx, fromMS int64) (int64, bool, error) {
+	first, ok := int64(0), false
+	c := tx.Bucket(serviceIndexBucket).Cursor()
+	err := tx.Bucket(servicesBucket).ForEach(func(service, _ []byte) error {
+		prefix, err := lex.Encode(string(service))
+		if err != nil {
+			return err
+		}
+		from, err := lex.Encode(string(service), fromMS*1000)
+		if err != nil {
+			return err
+		}
+		k, _ := c.Seek(from)
+		if k == nil || !bytes.HasPrefix(k, prefix) {
+			return nil
+		}
+		var timestamp int64
+		if _, err := lex.Decode(k[len(prefix):], &timestamp); err != nil {
+			return err
+		}
+		if !ok || timestamp < first {
+			first, ok = timestamp, true
+		}
+		return nil
+	})
+	return first / 1000, ok, err
+}
+
+// rollUpDependencies rolls up the dependency links from each period which
+// ended at least dependencyRollupDelay before now, and hasn't been already.
+func (s *boltDBStorage) rollUpDependencies(now time.Time) error {
+	complete := dependencyPeriod(now.Add(-dependencyRollupDelay).UnixNano() / int64(time.Millisecond))
+	for done := false; !done; {
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			through, err := dependenciesThrough(tx)
+			if err != nil || through >= complete {
+				done = true
 				return err
 			}
 
-			// Only want query.Limit traces
-			if traceID != previousTraceID {
-				previousTraceID = traceID
-				numTraces++
-				result = append(result, currentTrace)
-				currentTrace = nil
+			// Skip straight to the next period with any spans in it.
+			first, ok, err := firstTimestampMS(tx, through)
+			if err != nil {
+				return err
 			}
-			if numTraces > query.Limit {
-				return nil
+			period := complete
+			if ok && dependencyPeriod(first) < complete {
+				period = dependencyPeriod(first)
+			}
+			if period >= complete {
+				done = true
+				value, err := lex.Encode(complete)
+				if err != nil {
+					return err
+				}
+				return tx.Bucket(metaBucket).Put(dependenciesThroughKey, value)
 			}
 
-			span, err := decodeSpan(v)
+			linker := newDependencyLinker()
+			if err := tracesStarting(tx, period, period+dependencyPeriodMS, linker.addTrace); err != nil {
+				return err
+			}
+			if links := linker.result(); len(links) > 0 {
+				key, err := lex.Encode(period)
+				if err != nil {
+					return err
+				}
+				value, err := json.Marshal(links)
+				if err != nil {
+					return err
+				}
+				if err := tx.Bucket(dependenciesBucket).Put(key, value); err != nil {
+					return err
+				}
+			}
+			value, err := lex.Encode(period + dependencyPeriodMS)
 			if err != nil {
 				return err
 			}
-			currentTrace = append(currentTrace, span)
+			return tx.Bucket(metaBucket).Put(dependenciesThroughKey, value)
+		})
+		if err != nil {
+			return err
 		}
-		return nil
+	}
+	return nil
+}
+
+// Dependencies combines the rollups with links from the traces which started
+// after the last rollup.  Rollups cover whole periods, so may include links
+// from just outside the window.
+func (s *boltDBStorage) Dependencies(startMS, endMS int64) ([]DependencyLink, error) {
+	linker := newDependencyLinker()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		through, err := dependenciesThrough(tx)
+		if err != nil {
+			return err
+		}
+
+		start, err := lex.Encode(dependencyPeriod(startMS))
+		if err != nil {
+			return err
+		}
+		c := tx.Bucket(dependenciesBucket).Cursor()
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			var period int64
+			if _, err := lex.Decode(k, &period); err != nil {
+				return err
+			}
+			if period > endMS {
+				break
+			}
+			var links []DependencyLink
+			if err := json.Unmarshal(v, &links); err != nil {
+				return err
+			}
+			for _, link := range links {
+				linker.add(link)
+			}
+		}
+
+		if through > endMS {
+			return nil
+		}
+		if through > startMS {
+			startMS = through
+		}
+		return tracesStarting(tx, startMS, endMS+1, linker.addTrace)
 	})
-	return result, err
+	if err != nil {
+		return nil, err
+	}
+	return linker.result(), nil
 }
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+	"github.com/pmezard/go-difflib/difflib"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
+)
+
+func newTestSpan(traceID, id, timestamp int64, service, name string) *zipkincore.Span {
+	endpoint := zipkincore.NewEndpoint()
+	endpoint.ServiceName = service
+	duration := int64(10)
+	return &zipkincore.Span{
+		TraceID:   traceID,
+		ID:        id,
+		Name:      name,
+		Timestamp: &timestamp,
+		Duration:  &duration,
+		Annotations: []*zipkincore.Annotation{
+			{Timestamp: timestamp, Value: zipkincore.SERVER_RECV, Host: endpoint},
+		},
+		BinaryAnnotations: []*zipkincore.BinaryAnnotation{},
+	}
+}
+
+func newTestBoltDB(t *testing.T) (*boltDBStorage, func()) {
+	dir, err := ioutil.TempDir("", "loki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newBoltDBStorage(filepath.Join(dir, "traces.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltDBRoundTrip(t *testing.T) {
+	store, cleanup := newTestBoltDB(t)
+	defer cleanup()
+
+	spans := []*zipkincore.Span{
+		newTestSpan(1, 1, 1000000, "foo", "get"),
+		newTestSpan(1, 2, 1000005, "bar", "put"),
+		newTestSpan(2, 3, 2000000, "foo", "list"),
+	}
+	for _, span := range spans {
+		if err := store.Append(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	services, err := store.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bar", "foo"}; !reflect.DeepEqual(want, services) {
+		t.Fatalf("%s", diff(want, services))
+	}
+
+	names, err := store.SpanNames("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"get", "list"}; !reflect.DeepEqual(want, names) {
+		t.Fatalf("%s", diff(want, names))
+	}
+
+	trace, err := store.Trace(model.TraceID{Low: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 2; len(trace.Spans) != want {
+		t.Fatalf("expected %d spans, got %d", want, len(trace.Spans))
+	}
+
+	traces, err := store.Traces(Query{
+		ServiceName: "foo",
+		StartMS:     0,
+		EndMS:       3000,
+		Limit:       10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []int64{2, 1}, traceIDs(traces); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", diff(want, have))
+	}
+}
+
+func TestBoltDBTracesQuery(t *testing.T) {
+	store, cleanup := newTestBoltDB(t)
+	defer cleanup()
+
+	for i := int64(1); i <= 10; i++ {
+		name := "even"
+		if i%2 == 1 {
+			name = "odd"
+		}
+		if err := store.Append(newTestSpan(i, i, i*1000000, "foo", name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Append(newTestSpan(100+i, i, i*1000000, "bar", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		query Query
+		want  []int64
+	}{
+		{Query{ServiceName: "foo", StartMS: 0, EndMS: 20000, Limit: 3}, []int64{10, 9, 8}},
+		{Query{ServiceName: "foo", StartMS: 3000, EndMS: 5000, Limit: 10}, []int64{5, 4, 3}},
+		{Query{ServiceName: "foo", SpanName: "odd", StartMS: 0, EndMS: 6000, Limit: 2}, []int64{5, 3}},
+		{Query{ServiceName: "bar", StartMS: 9000, EndMS: 20000, Limit: 10}, []int64{110, 109}},
+		{Query{ServiceName: "baz", StartMS: 0, EndMS: 20000, Limit: 10}, []int64{}},
+		{Query{StartMS: 3000, EndMS: 5000, Limit: 3}, []int64{105, 5, 104}},
+		{Query{StartMS: 3000, EndMS: 5000, Limit: 3, Sort: SortOldest}, []int64{3, 103, 4}},
+		{Query{SpanName: "odd", StartMS: 0, EndMS: 20000, Limit: 2}, []int64{109, 9}},
+	} {
+		traces, err := store.Traces(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := traceIDs(traces); !reflect.DeepEqual(tc.want, have) {
+			t.Fatalf("%+v: %s", tc.query, diff(tc.want, have))
+		}
+	}
+}
+
+func TestBoltDBFiltersSurviveReopen(t *testing.T) {
+	store, cleanup := newTestBoltDB(t)
+	defer cleanup()
+
+	for i := int64(0); i < 10; i++ {
+		service := fmt.Sprintf("service%d", i)
+		if err := store.Append(newTestSpan(i, i, i*1000000, service, "get")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := store.db.Path()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newBoltDBStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	stats := store.FilterStats()
+	if want, have := uint(10), stats["services"].Entries; want != have {
+		t.Fatalf("expected %d services in filter, got %d", want, have)
+	}
+	if want, have := uint(10), stats["span_names"].Entries; want != have {
+		t.Fatalf("expected %d span names in filter, got %d", want, have)
+	}
+}
+
+func TestBoltDBFilterResize(t *testing.T) {
+	store, cleanup := newTestBoltDB(t)
+	defer cleanup()
+
+	store.servicesFilter = newIndexFilter(4)
+	for i := int64(0); i < 10; i++ {
+		service := fmt.Sprintf("service%d", i)
+		if err := store.Append(newTestSpan(i, i, i*1000000, service, "get")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := store.FilterStats()["services"]
+	if stats.Resizes == 0 || stats.Capacity < stats.Entries {
+		t.Fatalf("expected filter to have been resized: %+v", stats)
+	}
+
+	services, err := store.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 10, len(services); want != have {
+		t.Fatalf("expected %d services, got %d", want, have)
+	}
+}
+
+func TestIndexFilterReAdd(t *testing.T) {
+	f := newIndexFilter(100)
+	for _, key := range []string{"foo", "bar", "baz"} {
+		f.add([]byte(key))
+	}
+
+	// A key added back after being removed is still in the filter, so isn't
+	// counted again.
+	f.remove([]byte("foo"))
+	if f.test([]byte("foo")) {
+		t.Fatal("expected removed key not to be in the filter")
+	}
+	f.add([]byte("foo"))
+	if !f.test([]byte("foo")) {
+		t.Fatal("expected re-added key to be in the filter")
+	}
+	if want, have := uint(3), f.stats().Entries; want != have {
+		t.Fatalf("expected %d entries, got %d", want, have)
+	}
+}
+
+func TestBoltDBExpire(t *testing.T) {
+	store, cleanup := newTestBoltDB(t)
+	defer cleanup()
+
+	// Trace 3 started before the cutoff, but is kept whole as it has a
+	// later span; trace 5's span has no host, so isn't in the service index.
+	hostless := newTestSpan(5, 6, 1000000, "", "get")
+	hostless.Annotations = nil
+	for _, span := range []*zipkincore.Span{
+		newTestSpan(1, 1, 1000000, "old", "get"),
+		newTestSpan(2, 2, 1000000, "foo", "expired"),
+		newTestSpan(3, 3, 1000000, "bar", "early"),
+		newTestSpan(3, 4, 5000000, "foo", "kept"),
+		hostless,
+	} {
+		if err := store.Append(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.expire(2000000); err != nil {
+		t.Fatal(err)
+	}
+	for name, stats := range store.FilterStats() {
+		if stats.Resizes != 0 {
+			t.Fatalf("expected expiry not to resize the %s filter: %+v", name, stats)
+		}
+	}
+
+	services, err := store.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bar", "foo"}; !reflect.DeepEqual(want, services) {
+		t.Fatalf("%s", diff(want, services))
+	}
+
+	names, err := store.SpanNames("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"kept"}; !reflect.DeepEqual(want, names) {
+		t.Fatalf("%s", diff(want, names))
+	}
+
+	for _, id := range []uint64{2, 5} {
+		if _, err := store.Trace(model.TraceID{Low: id}); err != ErrNotFound {
+			t.Fatalf("expected trace %d to have been deleted, got %v", id, err)
+		}
+	}
+	trace, err := store.Trace(model.TraceID{Low: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(trace.Spans); want != have {
+		t.Fatalf("expected %d spans, got %d", want, have)
+	}
+
+	// Expired entries must be re-added when they're seen again.
+	if err := store.Append(newTestSpan(4, 4, 6000000, "old", "get")); err != nil {
+		t.Fatal(err)
+	}
+	names, err = store.SpanNames("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"get"}; !reflect.DeepEqual(want, names) {
+		t.Fatalf("%s", diff(want, names))
+	}
+}
+
+func TestBoltDBExpireInBatches(t *testing.T) {
+	store, cleanup := newTestBoltDB(t)
+	defer cleanup()
+
+	store.expireBatchSize = 2
+	for i := int64(1); i <= 5; i++ {
+		if err := store.Append(newTestSpan(i, i, 1000000, "foo", "get")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Append(newTestSpan(6, 6, 5000000, "foo", "get")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A trace which has had a span since the walk found it is kept.
+	if err := store.Append(newTestSpan(1, 7, 5000000, "foo", "get")); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := store.expireTraces([]model.TraceID{{Low: 1}, {Low: 2}}, 2000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, deleted; want != have {
+		t.Fatalf("expected %d traces deleted, got %d", want, have)
+	}
+
+	if err := store.expire(2000000); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint64{2, 3, 4, 5} {
+		if _, err := store.Trace(model.TraceID{Low: id}); err != ErrNotFound {
+			t.Fatalf("expected trace %d to have been deleted, got %v", id, err)
+		}
+	}
+	for _, id := range []uint64{1, 6} {
+		if _, err := store.Trace(model.TraceID{Low: id}); err != nil {
+			t.Fatalf("expected trace %d to have been kept, got %v", id, err)
+		}
+	}
+}
+
+func traceIDs(traces []Trace) []int64 {
+	result := make([]int64, 0, len(traces))
+	for _, trace := range traces {
+		result = append(result, int64(trace.ID.Low))
+	}
+	return result
+}
+
+// diff diffs two arbitrary data structures, giving human-readable output.
+func diff(want, have interface{}) string {
+	config := spew.NewDefaultConfig()
+	config.ContinueOnMethod = true
+	config.SortKeys = true
+	config.SpewKeys = true
+	text, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(config.Sdump(want)),
+		B:        difflib.SplitLines(config.Sdump(have)),
+		FromFile: "want",
+		ToFile:   "have",
+		Context:  3,
+	})
+	return "\n" + text
+}
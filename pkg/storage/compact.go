@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How often to look for blocks to compact.
+	compactionInterval = time.Minute
+
+	// Blocks are merged until they hold this many traces.
+	maxCompactedTraces = 32 * numMutableTraces
+)
+
+// compactable returns whether a block can be compacted.  When blocks are
+// being persisted, only those already on disk are compacted, so we never
+// race with persist or the WAL.
+func (s *inMemory) compactable(b block) bool {
+	if s.dir == "" {
+		return true
+	}
+	_, ok := b.(*diskBlock)
+	return ok
+}
+
+// planCompaction picks the oldest run of two or more neighbouring blocks
+// which together hold no more than maxCompactedTraces, and marks them as
+// compacting so retention leaves them alone whilst they're read.
+func (s *inMemory) planCompaction() []block {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for i := 0; i < len(s.immutableBlocks); i++ {
+		var run []block
+		var traces int
+		for _, b := range s.immutableBlocks[i:] {
+			if !s.compactable(b) || traces+b.numTraces() > maxCompactedTraces {
+				break
+			}
+			run = append(run, b)
+			traces += b.numTraces()
+		}
+		if len(run) > 1 {
+			for _, b := range run {
+				s.compacting[b] = struct{}{}
+			}
+			return run
+		}
+	}
+	return nil
+}
+
+// compact merges a run of neighbouring blocks into one, including the
+// pieces of any traces split between them.
+func (s *inMemory) compact() error {
+	run := s.planCompaction()
+	if run == nil {
+		return nil
+	}
+	return s.compactRun(run)
+}
+
+// compactRun merges a run planned by planCompaction.  Retention skips the
+// run's blocks until they've been swapped for the merged block.
+func (s *inMemory) compactRun(run []block) error {
+	defer func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		for _, b := range run {
+			delete(s.compacting, b)
+		}
+	}()
+
+	var traces [][]Trace
+	var segments walRange
+	for _, b := range run {
+		ts, err := b.allTraces()
+		if err != nil {
+			return err
+		}
+		traces = append(traces, ts)
+		if d, ok := b.(*diskBlock); ok {
+			segments = segments.merge(d.segments)
+		}
+	}
+	var merged block = newImmutableBlockFromTraces(mergeTraceListList(traces))
+	if s.dir != "" {
+		path, err := writeBlockFile(s.dir, merged, segments)
+		if err != nil {
+			return err
+		}
+		if merged, err = openBlockFile(path); err != nil {
+			return err
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Nothing else replaces the run's blocks, nor adds blocks in front of
+	// the newest.
+	first := 0
+	for s.immutableBlocks[first] != run[0] {
+		first++
+	}
+	for _, b := range run {
+		s.unindexBlock(b)
+		if err := dropBlock(b); err != nil {
+			return err
+		}
+	}
+	s.indexBlock(merged)
+	immutableBlocks := make([]block, 0, len(s.immutableBlocks)-len(run)+1)
+	immutableBlocks = append(immutableBlocks, s.immutableBlocks[:first]...)
+	immutableBlocks = append(immutableBlocks, merged)
+	immutableBlocks = append(immutableBlocks, s.immutableBlocks[first+len(run):]...)
+	s.immutableBlocks = immutableBlocks
+
+	log.Infof("Compacted %d blocks into one of %d traces", len(run), merged.numTraces())
+	return nil
+}
+
+func (s *inMemory) startCompactor() *loop {
+	return startLoop(compactionInterval, func() {
+		if err := s.compact(); err != nil {
+			log.Errorf("Error compacting blocks: %v", err)
+		}
+	})
+}
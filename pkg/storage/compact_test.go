@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
+)
+
+func TestCompact(t *testing.T) {
+	for _, dir := range []bool{false, true} {
+		cfg := Config{}
+		if dir {
+			d, err := ioutil.TempDir("", "loki")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(d)
+			cfg.BlocksDir = d
+		}
+		s, err := NewSpanStore(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := s.(*inMemory)
+
+		// Trace 2 is split between the first two blocks.
+		blocks := [][]Trace{
+			{*newTrace(newTestSpan(1, 1, 1000000, "foo", "get")), *newTrace(newTestSpan(2, 2, 2000000, "foo", "get"))},
+			{*newTrace(newTestSpan(2, 3, 2000005, "bar", "put")), *newTrace(newTestSpan(3, 4, 3000000, "foo", "get"))},
+			{*newTrace(newTestSpan(4, 5, 4000000, "foo", "get"))},
+		}
+		for _, traces := range blocks {
+			var b block = newImmutableBlockFromTraces(traces)
+			if dir {
+				path, err := writeBlockFile(cfg.BlocksDir, b, walRange{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b, err = openBlockFile(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store.immutableBlocks = append(store.immutableBlocks, b)
+			store.indexBlock(b)
+		}
+
+		if err := store.compact(); err != nil {
+			t.Fatal(err)
+		}
+		if want, have := 1, len(store.immutableBlocks); want != have {
+			t.Fatalf("expected %d blocks, got %d", want, have)
+		}
+		if want, have := 4, store.immutableBlocks[0].numTraces(); want != have {
+			t.Fatalf("expected %d traces, got %d", want, have)
+		}
+		if dir {
+			files, err := ioutil.ReadDir(cfg.BlocksDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := 1, len(files); want != have {
+				t.Fatalf("expected %d block files, got %d", want, have)
+			}
+		}
+
+		trace, err := store.Trace(model.TraceID{Low: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := 2, len(trace.Spans); want != have {
+			t.Fatalf("expected %d spans, got %d", want, have)
+		}
+
+		traces, err := store.Traces(Query{ServiceName: "bar", StartMS: 0, EndMS: 1 << 40, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := []int64{2}, traceIDs(traces); !reflect.DeepEqual(want, have) {
+			t.Fatalf("%s", diff(want, have))
+		}
+
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpireWhilstCompacting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSpanStore(Config{BlocksDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := s.(*inMemory)
+	defer store.Close()
+
+	for i := int64(1); i <= 2; i++ {
+		b := newImmutableBlockFromTraces([]Trace{*newTrace(newTestSpan(i, i, i*1000000, "foo", "get"))})
+		path, err := writeBlockFile(dir, b, walRange{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := openBlockFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.immutableBlocks = append(store.immutableBlocks, d)
+		store.indexBlock(d)
+	}
+
+	// Retention runs after the run is planned, but before it's read.
+	run := store.planCompaction()
+	if want, have := 2, len(run); want != have {
+		t.Fatalf("expected a run of %d blocks, got %d", want, have)
+	}
+	if err := store.expire(6000000); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(store.immutableBlocks); want != have {
+		t.Fatalf("expected the compacting blocks to be kept, got %d", have)
+	}
+	if err := store.compactRun(run); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, len(store.immutableBlocks); want != have {
+		t.Fatalf("expected %d block, got %d", want, have)
+	}
+	if want, have := 0, len(store.compacting); want != have {
+		t.Fatalf("expected %d compacting blocks, got %d", want, have)
+	}
+
+	// Once compacted, the merged block is expired.
+	if err := store.expire(6000000); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0, len(store.immutableBlocks); want != have {
+		t.Fatalf("expected %d blocks, got %d", want, have)
+	}
+}
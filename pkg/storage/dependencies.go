@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+)
+
+// Dependency links are rolled up into buckets of this many milliseconds, so
+// the graph can be served without reading raw traces, and outlives them.
+const dependencyPeriodMS = int64(time.Hour / time.Millisecond)
+
+// DependencyLink is an aggregate of the calls from one service to another.
+type DependencyLink struct {
+	Parent     string
+	Child      string
+	CallCount  int64
+	ErrorCount int64
+}
+
+type dependencyKey struct {
+	parent, child string
+}
+
+// dependencyLinker aggregates the service calls in traces into
+// DependencyLinks.
+type dependencyLinker struct {
+	links map[dependencyKey]*DependencyLink
+}
+
+func newDependencyLinker() *dependencyLinker {
+	return &dependencyLinker{
+		links: map[dependencyKey]*DependencyLink{},
+	}
+}
+
+// spanServices describes which services were involved in a span.  In Zipkin
+// v1, the client and server sides of an RPC share a span, so a span can have
+// both.
+type spanServices struct {
+	client, server, remote, local string
+	err                           bool
+}
+
+func getSpanServices(spans []*zipkincore.Span) spanServices {
+	var result spanServices
+	for _, span := range spans {
+		for _, annotation := range span.Annotations {
+			service := annotation.GetHost().GetServiceName()
+			switch annotation.Value {
+			case zipkincore.CLIENT_SEND, zipkincore.CLIENT_RECV:
+				result.client = service
+			case zipkincore.SERVER_RECV, zipkincore.SERVER_SEND:
+				result.server = service
+			case "error":
+				result.err = true
+			}
+			if result.local == "" {
+				result.local = service
+			}
+		}
+		for _, annotation := range span.BinaryAnnotations {
+			switch annotation.Key {
+			case zipkincore.SERVER_ADDR:
+				result.remote = annotation.GetHost().GetServiceName()
+			case "error":
+				result.err = true
+			}
+			if result.local == "" {
+				result.local = annotation.GetHost().GetServiceName()
+			}
+		}
+	}
+	return result
+}
+
+// service returns the service a span ran in; for RPCs, that's the server.
+func (s spanServices) service() string {
+	switch {
+	case s.server != "":
+		return s.server
+	case s.client != "":
+		return s.client
+	default:
+		return s.local
+	}
+}
+
+// addTrace adds the calls in a trace to the links.  An RPC span links its
+// client to its server (or the service at its server address); any other span
+// links its parent's service to its own.
+func (l *dependencyLinker) addTrace(trace *Trace) {
+	// The client and server halves of a span may have been reported
+	// separately, so group them by ID.
+	byID := map[int64][]*zipkincore.Span{}
+	for _, span := range trace.Spans {
+		byID[span.ID] = append(byID[span.ID], span)
+	}
+
+	for id, spans := range byID {
+		services := getSpanServices(spans)
+		parent, child := "", services.service()
+		switch {
+		case services.client != "" && services.server != "":
+			parent = services.client
+		case services.client != "" && services.remote != "":
+			parent, child = services.client, services.remote
+		case spans[0].ParentID != nil && *spans[0].ParentID != id:
+			if parentSpans, ok := byID[*spans[0].ParentID]; ok {
+				parent = getSpanServices(parentSpans).service()
+			}
+		}
+		if parent == "" || child == "" || parent == child {
+			continue
+		}
+		link := DependencyLink{Parent: parent, Child: child, CallCount: 1}
+		if services.err {
+			link.ErrorCount = 1
+		}
+		l.add(link)
+	}
+}
+
+// add adds the counts in link to the existing link between its services.
+func (l *dependencyLinker) add(link DependencyLink) {
+	key := dependencyKey{link.Parent, link.Child}
+	existing, ok := l.links[key]
+	if !ok {
+		existing = &DependencyLink{Parent: link.Parent, Child: link.Child}
+		l.links[key] = existing
+	}
+	existing.CallCount += link.CallCount
+	existing.ErrorCount += link.ErrorCount
+}
+
+// result returns the links, sorted by parent and then child.
+func (l *dependencyLinker) result() []DependencyLink {
+	result := make([]DependencyLink, 0, len(l.links))
+	for _, link := range l.links {
+		result = append(result, *link)
+	}
+	sort.Sort(byParentChild(result))
+	return result
+}
+
+type byParentChild []DependencyLink
+
+func (ls byParentChild) Len() int      { return len(ls) }
+func (ls byParentChild) Swap(i, j int) { ls[i], ls[j] = ls[j], ls[i] }
+func (ls byParentChild) Less(i, j int) bool {
+	if ls[i].Parent != ls[j].Parent {
+		return ls[i].Parent < ls[j].Parent
+	}
+	return ls[i].Child < ls[j].Child
+}
+
+// dependencyRollups holds dependency links aggregated by the period in which
+// their traces started, keyed by the start of the period in milliseconds.
+type dependencyRollups map[int64]*dependencyLinker
+
+// dependencyPeriod returns the start of the period holding timestampMS.
+func dependencyPeriod(timestampMS int64) int64 {
+	return timestampMS - timestampMS%dependencyPeriodMS
+}
+
+func (r dependencyRollups) addTrace(trace *Trace) {
+	period := dependencyPeriod(trace.MinTimestamp / 1000)
+	linker, ok := r[period]
+	if !ok {
+		linker = newDependencyLinker()
+		r[period] = linker
+	}
+	linker.addTrace(trace)
+}
+
+// addTo adds the links from every period overlapping startMS to endMS to
+// linker.
+func (r dependencyRollups) addTo(linker *dependencyLinker, startMS, endMS int64) {
+	for period, links := range r {
+		if period+dependencyPeriodMS <= startMS || period > endMS {
+			continue
+		}
+		for _, link := range links.links {
+			linker.add(*link)
+		}
+	}
+}
+
+// savedDependencyRollups is the file format for rollups, along with the start
+// of the first period not yet rolled up.
+type savedDependencyRollups struct {
+	Through int64                      `json:"through"`
+	Periods map[int64][]DependencyLink `json:"periods"`
+}
+
+func (r dependencyRollups) save(path string, through int64) error {
+	saved := savedDependencyRollups{
+		Through: through,
+		Periods: make(map[int64][]DependencyLink, len(r)),
+	}
+	for period, linker := range r {
+		saved.Periods[period] = linker.result()
+	}
+	buf, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, buf)
+}
+
+// loadDependencyRollups reads rollups written by save, and where they were
+// rolled up through; a missing file means there are none yet.
+func loadDependencyRollups(path string) (dependencyRollups, int64, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return dependencyRollups{}, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	var saved savedDependencyRollups
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		return nil, 0, err
+	}
+	r := make(dependencyRollups, len(saved.Periods))
+	for period, links := range saved.Periods {
+		r[period] = newDependencyLinker()
+		for _, link := range links {
+			r[period].add(link)
+		}
+	}
+	return r, saved.Through, nil
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+)
+
+func newTestRPCSpan(traceID, id, parentID int64, service string, annotations ...string) *zipkincore.Span {
+	span := newTestSpan(traceID, id, traceID*1000000, service, "rpc")
+	if parentID != 0 {
+		span.ParentID = &parentID
+	}
+	host := span.Annotations[0].Host
+	span.Annotations = nil
+	for _, value := range annotations {
+		span.Annotations = append(span.Annotations, &zipkincore.Annotation{
+			Timestamp: traceID * 1000000,
+			Value:     value,
+			Host:      host,
+		})
+	}
+	return span
+}
+
+// newTestDependencySpans returns two traces, at 1s and 2s, in which web calls
+// api, which calls db.  The first call to db fails.
+func newTestDependencySpans() []*zipkincore.Span {
+	db := zipkincore.NewEndpoint()
+	db.ServiceName = "db"
+	var spans []*zipkincore.Span
+	for i := int64(1); i <= 2; i++ {
+		// web serves the request, and calls api, whose client and server
+		// halves are reported separately.
+		spans = append(spans,
+			newTestRPCSpan(i, 1, 0, "web", zipkincore.SERVER_RECV, zipkincore.SERVER_SEND),
+			newTestRPCSpan(i, 2, 1, "web", zipkincore.CLIENT_SEND, zipkincore.CLIENT_RECV),
+			newTestRPCSpan(i, 2, 1, "api", zipkincore.SERVER_RECV, zipkincore.SERVER_SEND),
+		)
+
+		// api calls the uninstrumented db, and the first time it fails.
+		call := newTestRPCSpan(i, 3, 2, "api", zipkincore.CLIENT_SEND, zipkincore.CLIENT_RECV)
+		call.BinaryAnnotations = append(call.BinaryAnnotations, &zipkincore.BinaryAnnotation{
+			Key:            zipkincore.SERVER_ADDR,
+			Value:          []byte{1},
+			AnnotationType: zipkincore.AnnotationType_BOOL,
+			Host:           db,
+		})
+		if i == 1 {
+			call.Annotations = append(call.Annotations, &zipkincore.Annotation{
+				Timestamp: i * 1000000,
+				Value:     "error",
+				Host:      call.Annotations[0].Host,
+			})
+		}
+		spans = append(spans, call)
+
+		// And does some local work, which isn't a dependency.
+		spans = append(spans, newTestRPCSpan(i, 4, 2, "api", "lc"))
+	}
+	return spans
+}
+
+func TestDependencies(t *testing.T) {
+	bolt, cleanup := newTestBoltDB(t)
+	defer cleanup()
+	memory, err := NewSpanStore(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memory.Close()
+
+	spans := newTestDependencySpans()
+	for _, store := range []SpanStore{bolt, memory} {
+		for _, span := range spans {
+			if err := store.Append(span); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		startMS, endMS int64
+		want           []DependencyLink
+	}{
+		{0, 10000, []DependencyLink{
+			{Parent: "api", Child: "db", CallCount: 2, ErrorCount: 1},
+			{Parent: "web", Child: "api", CallCount: 2},
+		}},
+		{1500, 10000, []DependencyLink{
+			{Parent: "api", Child: "db", CallCount: 1},
+			{Parent: "web", Child: "api", CallCount: 1},
+		}},
+		{5000, 10000, []DependencyLink{}},
+	} {
+		for _, store := range []SpanStore{bolt, memory} {
+			have, err := store.Dependencies(tc.startMS, tc.endMS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.want, have) {
+				t.Fatalf("%T %d-%d: %s", store, tc.startMS, tc.endMS, diff(tc.want, have))
+			}
+		}
+	}
+}
+
+func TestDependencyRollupsOutliveTraces(t *testing.T) {
+	want := []DependencyLink{
+		{Parent: "api", Child: "db", CallCount: 2, ErrorCount: 1},
+		{Parent: "web", Child: "api", CallCount: 2},
+	}
+
+	bolt, cleanup := newTestBoltDB(t)
+	defer cleanup()
+	for _, span := range newTestDependencySpans() {
+		if err := bolt.Append(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bolt.rollUpDependencies(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := bolt.expire(1 << 62); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := bolt.Dependencies(0, 10000); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", diff(want, have))
+	}
+
+	dir, err := ioutil.TempDir("", "loki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSpanStore(Config{BlocksDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, span := range newTestDependencySpans() {
+		if err := s.Append(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.(*inMemory).rollUpDependencies(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewSpanStore(Config{BlocksDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.(*inMemory).expire(1 << 62); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := s.Dependencies(0, 10000); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", diff(want, have))
+	}
+}
+
+func TestDependencyRollupsOfSplitTraces(t *testing.T) {
+	s, err := NewSpanStore(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	store := s.(*inMemory)
+
+	// Each trace's spans are split between two blocks, the client and server
+	// halves of the call to api falling in different ones.
+	spans := newTestDependencySpans()
+	for _, half := range [][]*zipkincore.Span{spans[:2], spans[2:7], spans[7:]} {
+		var traces []Trace
+		for _, span := range half {
+			if n := len(traces); n > 0 && traces[n-1].ID == newTrace(span).ID {
+				traces[n-1].addSpan(span)
+				continue
+			}
+			traces = append(traces, *newTrace(span))
+		}
+		b := newImmutableBlockFromTraces(traces)
+		store.immutableBlocks = append(store.immutableBlocks, b)
+		store.indexBlock(b)
+	}
+
+	if err := store.rollUpDependencies(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.expire(1 << 62); err != nil {
+		t.Fatal(err)
+	}
+	want := []DependencyLink{
+		{Parent: "api", Child: "db", CallCount: 2, ErrorCount: 1},
+		{Parent: "web", Child: "api", CallCount: 2},
+	}
+	if have, err := s.Dependencies(0, 10000); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", diff(want, have))
+	}
+}
@@ -0,0 +1,577 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/golang/snappy"
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
+)
+
+// Block files are laid out as:
+//
+//	header:  magic (4 bytes), version (1 byte), compression (1 byte),
+//	         first and last WAL segment holding the traces (4 bytes each)
+//	traces:  one snappy-compressed, thrift-encoded list of spans per trace,
+//	         in MinTimestamp order
+//	index:   snappy-compressed table of contents - see encodeBlockIndex
+//	footer:  index offset (8 bytes), index length (8 bytes),
+//	         CRC32 of the index (4 bytes)
+//
+// All the fixed-size integers are big endian.  The index is read into memory
+// when a block is opened, but spans are only decoded from the memory-mapped
+// file when a trace is read.
+const (
+	blockMagic         = "LOKI"
+	blockVersion       = 1
+	blockHeaderLen     = 14
+	blockFooterLen     = 20
+	blockFileExtension = ".block"
+
+	compressionSnappy = 1
+)
+
+// traceEntry describes where a trace is in a block file.
+type traceEntry struct {
+	id           model.TraceID
+	minTimestamp int64
+	maxTimestamp int64
+	offset       uint64
+	length       uint64
+}
+
+type diskBlock struct {
+	path          string
+	data          []byte // memory-mapped
+	from, through int64  // in us
+	entries       []traceEntry
+	traceIDs      map[model.TraceID]int
+	services      []string
+	spanNames     map[string][]string
+	tags          map[string][]int // term -> ascending indexes into entries
+	segments      walRange         // empty if the block wasn't logged
+}
+
+// writeBlockFile writes a block's traces to a new file in dir, returning
+// the file's path.  segments is recorded so the WAL isn't replayed over the
+// block on startup.
+func writeBlockFile(dir string, b block, segments walRange) (string, error) {
+	traces, err := b.allTraces()
+	if err != nil {
+		return "", err
+	}
+	if len(traces) == 0 {
+		return "", fmt.Errorf("refusing to write empty block")
+	}
+	services, err := b.Services()
+	if err != nil {
+		return "", err
+	}
+	spanNames := make(map[string][]string, len(services))
+	for _, service := range services {
+		if spanNames[service], err = b.SpanNames(service); err != nil {
+			return "", err
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(blockMagic)
+	buf.WriteByte(blockVersion)
+	buf.WriteByte(compressionSnappy)
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(segments.first))
+	binary.BigEndian.PutUint32(header[4:], uint32(segments.last))
+	buf.Write(header[:])
+
+	entries := make([]traceEntry, 0, len(traces))
+	tags := map[string][]int{}
+	for i, trace := range traces {
+		for _, span := range trace.Spans {
+			for _, term := range spanTerms(span) {
+				if postings := tags[term]; len(postings) == 0 || postings[len(postings)-1] != i {
+					tags[term] = append(postings, i)
+				}
+			}
+		}
+
+		encoded, err := encodeSpans(trace.Spans)
+		if err != nil {
+			return "", err
+		}
+		compressed := snappy.Encode(nil, encoded)
+		entries = append(entries, traceEntry{
+			id:           trace.ID,
+			minTimestamp: trace.MinTimestamp,
+			maxTimestamp: trace.MaxTimestamp,
+			offset:       uint64(buf.Len()),
+			length:       uint64(len(compressed)),
+		})
+		buf.Write(compressed)
+	}
+
+	index := snappy.Encode(nil, encodeBlockIndex(entries, spanNames, tags))
+	var footer [blockFooterLen]byte
+	binary.BigEndian.PutUint64(footer[0:], uint64(buf.Len()))
+	binary.BigEndian.PutUint64(footer[8:], uint64(len(index)))
+	binary.BigEndian.PutUint32(footer[16:], crc32.ChecksumIEEE(index))
+	buf.Write(index)
+	buf.Write(footer[:])
+
+	name := fmt.Sprintf("%020d-%08x%s", traces[0].MinTimestamp, rand.Uint32(), blockFileExtension)
+	path := filepath.Join(dir, name)
+	return path, writeFileAtomically(path, buf.Bytes())
+}
+
+// writeFileAtomically writes to a temporary file and renames it into place,
+// so a crash never leaves a partial file behind.
+func writeFileAtomically(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// encodeBlockIndex encodes the trace entries, then the services and their
+// span names, and then the tag terms and their delta-encoded posting lists,
+// using varints and length-prefixed strings.
+func encodeBlockIndex(entries []traceEntry, spanNames map[string][]string, tags map[string][]int) []byte {
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], v)])
+	}
+	putVarint := func(v int64) {
+		buf.Write(scratch[:binary.PutVarint(scratch[:], v)])
+	}
+	putString := func(s string) {
+		putUvarint(uint64(len(s)))
+		buf.WriteString(s)
+	}
+
+	putUvarint(uint64(len(entries)))
+	for _, e := range entries {
+		putVarint(int64(e.id.Low))
+		putVarint(int64(e.id.High))
+		putVarint(e.minTimestamp)
+		putVarint(e.maxTimestamp)
+		putUvarint(e.offset)
+		putUvarint(e.length)
+	}
+
+	services := make([]string, 0, len(spanNames))
+	for service := range spanNames {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	putUvarint(uint64(len(services)))
+	for _, service := range services {
+		putString(service)
+		putUvarint(uint64(len(spanNames[service])))
+		for _, name := range spanNames[service] {
+			putString(name)
+		}
+	}
+
+	terms := make([]string, 0, len(tags))
+	for term := range tags {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	putUvarint(uint64(len(terms)))
+	for _, term := range terms {
+		putString(term)
+		putUvarint(uint64(len(tags[term])))
+		previous := 0
+		for _, i := range tags[term] {
+			putUvarint(uint64(i - previous))
+			previous = i
+		}
+	}
+	return buf.Bytes()
+}
+
+type indexDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *indexDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = fmt.Errorf("corrupt block index")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *indexDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = fmt.Errorf("corrupt block index")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *indexDecoder) string() string {
+	l := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.buf)) < l {
+		d.err = fmt.Errorf("corrupt block index")
+		return ""
+	}
+	s := string(d.buf[:l])
+	d.buf = d.buf[l:]
+	return s
+}
+
+// openBlockFile memory-maps a block file and reads its index.
+func openBlockFile(path string) (*diskBlock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < blockHeaderLen+blockFooterLen {
+		return nil, fmt.Errorf("%s: too short to be a block", path)
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	b, err := parseBlock(path, data)
+	if err != nil {
+		syscall.Munmap(data)
+		return nil, err
+	}
+	return b, nil
+}
+
+func parseBlock(path string, data []byte) (*diskBlock, error) {
+	if len(data) < blockHeaderLen+blockFooterLen {
+		return nil, fmt.Errorf("%s: too short to be a block", path)
+	}
+	if string(data[:4]) != blockMagic {
+		return nil, fmt.Errorf("%s: not a block file", path)
+	}
+	if data[4] != blockVersion {
+		return nil, fmt.Errorf("%s: unknown block version %d", path, data[4])
+	}
+	if data[5] != compressionSnappy {
+		return nil, fmt.Errorf("%s: unknown compression %d", path, data[5])
+	}
+
+	// Check the footer against the file's size without adding the untrusted
+	// offset and length, which could overflow.
+	footer := data[len(data)-blockFooterLen:]
+	indexOffset := binary.BigEndian.Uint64(footer[0:])
+	indexLength := binary.BigEndian.Uint64(footer[8:])
+	indexEnd := uint64(len(data) - blockFooterLen)
+	if indexOffset < blockHeaderLen || indexOffset > indexEnd || indexLength != indexEnd-indexOffset {
+		return nil, fmt.Errorf("%s: corrupt footer", path)
+	}
+	compressed := data[indexOffset : indexOffset+indexLength]
+	if crc32.ChecksumIEEE(compressed) != binary.BigEndian.Uint32(footer[16:]) {
+		return nil, fmt.Errorf("%s: index checksum mismatch", path)
+	}
+	index, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	d := indexDecoder{buf: index}
+	numEntries := d.uvarint()
+	entries := []traceEntry{}
+	traceIDs := map[model.TraceID]int{}
+	from, through := int64(math.MaxInt64), int64(math.MinInt64)
+	for i := uint64(0); i < numEntries && d.err == nil; i++ {
+		var e traceEntry
+		e.id.Low = uint64(d.varint())
+		e.id.High = uint64(d.varint())
+		e.minTimestamp = d.varint()
+		e.maxTimestamp = d.varint()
+		e.offset = d.uvarint()
+		e.length = d.uvarint()
+		if e.offset < blockHeaderLen || e.offset > indexOffset || e.length > indexOffset-e.offset {
+			return nil, fmt.Errorf("%s: trace %s out of bounds", path, e.id)
+		}
+		traceIDs[e.id] = len(entries)
+		entries = append(entries, e)
+		from = min(from, e.minTimestamp)
+		through = max(through, e.maxTimestamp)
+	}
+
+	numServices := d.uvarint()
+	services := []string{}
+	spanNames := map[string][]string{}
+	for i := uint64(0); i < numServices && d.err == nil; i++ {
+		service := d.string()
+		numNames := d.uvarint()
+		names := []string{}
+		for j := uint64(0); j < numNames && d.err == nil; j++ {
+			names = append(names, d.string())
+		}
+		services = append(services, service)
+		spanNames[service] = names
+	}
+
+	tags := map[string][]int{}
+	numTerms := d.uvarint()
+	for i := uint64(0); i < numTerms && d.err == nil; i++ {
+		term := d.string()
+		numPostings := d.uvarint()
+		postings := []int{}
+		previous := uint64(0)
+		for j := uint64(0); j < numPostings && d.err == nil; j++ {
+			delta := d.uvarint()
+			if delta >= uint64(len(entries))-previous {
+				return nil, fmt.Errorf("%s: tag posting out of bounds", path)
+			}
+			previous += delta
+			postings = append(postings, int(previous))
+		}
+		tags[term] = postings
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%s: %v", path, d.err)
+	}
+
+	return &diskBlock{
+		path:      path,
+		data:      data,
+		from:      from,
+		through:   through,
+		entries:   entries,
+		traceIDs:  traceIDs,
+		services:  services,
+		spanNames: spanNames,
+		tags:      tags,
+		segments: walRange{
+			first: int(binary.BigEndian.Uint32(data[6:])),
+			last:  int(binary.BigEndian.Uint32(data[10:])),
+		},
+	}, nil
+}
+
+// loadBlockFiles opens all the block files in dir, oldest first.
+func loadBlockFiles(dir string) ([]*diskBlock, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []*diskBlock
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		switch filepath.Ext(file.Name()) {
+		case blockFileExtension:
+		case ".tmp":
+			// Left over from a crash during writeFileAtomically.
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+			continue
+		default:
+			continue
+		}
+
+		b, err := openBlockFile(path)
+		if err != nil {
+			for _, b := range blocks {
+				b.Close()
+			}
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+func (s *diskBlock) Close() error {
+	return syscall.Munmap(s.data)
+}
+
+func (s *diskBlock) read(e traceEntry) (Trace, error) {
+	decompressed, err := snappy.Decode(nil, s.data[e.offset:e.offset+e.length])
+	if err != nil {
+		return Trace{}, err
+	}
+	spans, err := decodeSpans(decompressed)
+	if err != nil {
+		return Trace{}, err
+	}
+	return Trace{
+		ID:           e.id,
+		MinTimestamp: e.minTimestamp,
+		MaxTimestamp: e.maxTimestamp,
+		Spans:        spans,
+	}, nil
+}
+
+func (s *diskBlock) allTraces() ([]Trace, error) {
+	traces := make([]Trace, 0, len(s.entries))
+	for _, e := range s.entries {
+		trace, err := s.read(e)
+		if err != nil {
+			return nil, err
+		}
+		traces = append(traces, trace)
+	}
+	return traces, nil
+}
+
+func (s *diskBlock) numTraces() int {
+	return len(s.entries)
+}
+
+func (s *diskBlock) bounds() (int64, int64) {
+	return s.from, s.through
+}
+
+func (s *diskBlock) ids() []model.TraceID {
+	ids := make([]model.TraceID, 0, len(s.entries))
+	for _, e := range s.entries {
+		ids = append(ids, e.id)
+	}
+	return ids
+}
+
+// expire only ever drops whole block files; the block is kept until every
+// trace in it has expired.
+func (s *diskBlock) expire(cutoffUS int64) (block, error) {
+	if s.through >= cutoffUS {
+		return s, nil
+	}
+	return nil, nil
+}
+
+func (s *diskBlock) Services() ([]string, error) {
+	return s.services, nil
+}
+
+func (s *diskBlock) SpanNames(serviceName string) ([]string, error) {
+	return s.spanNames[serviceName], nil
+}
+
+func (s *diskBlock) Trace(id model.TraceID) (Trace, error) {
+	i, ok := s.traceIDs[id]
+	if !ok {
+		return Trace{}, nil
+	}
+	return s.read(s.entries[i])
+}
+
+func (s *diskBlock) Traces(query Query) ([]Trace, error) {
+	first := sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].minTimestamp >= (query.StartMS * 1000)
+	})
+	last := sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].minTimestamp > (query.EndMS * 1000)
+	})
+
+	// If the query has tags, only read traces in the shortest posting list.
+	postings, ok := selectivePostings(s.tags, query.terms())
+	if !ok {
+		postings = nil
+		for i := first; i < last; i++ {
+			postings = append(postings, i)
+		}
+	}
+
+	var traces []Trace
+	for _, i := range postings {
+		if i < first || i >= last {
+			continue
+		}
+		trace, err := s.read(s.entries[i])
+		if err != nil {
+			return nil, err
+		}
+		traces = append(traces, trace)
+	}
+	return traces, nil
+}
+
+func encodeSpans(spans []*zipkincore.Span) ([]byte, error) {
+	transport := thrift.NewTMemoryBuffer()
+	protocol := thrift.NewTCompactProtocol(transport)
+	if err := protocol.WriteListBegin(thrift.STRUCT, len(spans)); err != nil {
+		return nil, err
+	}
+	for _, span := range spans {
+		if err := span.Write(protocol); err != nil {
+			return nil, err
+		}
+	}
+	if err := protocol.WriteListEnd(); err != nil {
+		return nil, err
+	}
+	if err := protocol.Flush(); err != nil {
+		return nil, err
+	}
+	return transport.Buffer.Bytes(), nil
+}
+
+func decodeSpans(buf []byte) ([]*zipkincore.Span, error) {
+	transport := thrift.NewTMemoryBuffer()
+	transport.Buffer = bytes.NewBuffer(buf)
+	protocol := thrift.NewTCompactProtocol(transport)
+	ttype, size, err := protocol.ReadListBegin()
+	if err != nil {
+		return nil, err
+	}
+	if ttype != thrift.STRUCT {
+		return nil, fmt.Errorf("unexpected type: %v", ttype)
+	}
+	spans := make([]*zipkincore.Span, 0, size)
+	for i := 0; i < size; i++ {
+		span := zipkincore.NewSpan()
+		if err := span.Read(protocol); err != nil {
+			return nil, err
+		}
+		spans = append(spans, span)
+	}
+	return spans, protocol.ReadListEnd()
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseCorruptBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newImmutableBlockFromTraces([]Trace{
+		*newTrace(newTestSpan(1, 1, 1000000, "foo", "get")),
+		*newTrace(newTestSpan(2, 2, 2000000, "bar", "put")),
+	})
+	path, err := writeBlockFile(dir, b, walRange{first: 3, last: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := parseBlock(path, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := (walRange{first: 3, last: 4}), d.segments; want != have {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+
+	footer := len(data) - blockFooterLen
+	withFooter := func(offset, length uint64) []byte {
+		corrupt := append([]byte{}, data...)
+		binary.BigEndian.PutUint64(corrupt[footer:], offset)
+		binary.BigEndian.PutUint64(corrupt[footer+8:], length)
+		return corrupt
+	}
+	indexOffset := binary.BigEndian.Uint64(data[footer:])
+	for name, corrupt := range map[string][]byte{
+		"truncated":        data[:len(data)-1],
+		"header only":      data[:blockHeaderLen],
+		"overflowing":      withFooter(1<<63, 1<<63+uint64(footer)),
+		"past the end":     withFooter(uint64(len(data)), 0),
+		"inside header":    withFooter(0, uint64(footer)),
+		"short index":      withFooter(indexOffset, uint64(footer)-indexOffset-1),
+		"index in spans":   withFooter(blockHeaderLen+1, uint64(footer)-blockHeaderLen-1),
+		"unknown version":  append(append([]byte{}, data[:4]...), append([]byte{blockVersion + 1}, data[5:]...)...),
+		"not a block file": append([]byte("KILO"), data[4:]...),
+	} {
+		if _, err := parseBlock(path, corrupt); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
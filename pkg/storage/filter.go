@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"math"
+
+	"github.com/willf/bloom"
+)
+
+const falsePositiveRate = 0.01
+
+// A filter is rebuilt once this fraction of its entries have been removed.
+const staleFraction = 0.1
+
+// FilterStats describes the state of one of the bloom filters used to
+// minimise index writes.
+type FilterStats struct {
+	Entries                    uint
+	Capacity                   uint
+	Resizes                    uint
+	EstimatedFalsePositiveRate float64
+}
+
+// indexFilter is a bloom filter which knows how many entries it was sized
+// for, and how many it contains, so it can tell when it needs to be rebuilt
+// with a larger capacity.  Bloom filters can't forget keys, so keys removed
+// from the index are remembered separately until the filter is rebuilt.
+type indexFilter struct {
+	filter   *bloom.BloomFilter
+	entries  uint
+	capacity uint
+	resizes  uint
+	removed  map[string]struct{}
+}
+
+func newIndexFilter(capacity uint) *indexFilter {
+	return &indexFilter{
+		filter:   bloom.NewWithEstimates(capacity, falsePositiveRate),
+		capacity: capacity,
+		removed:  map[string]struct{}{},
+	}
+}
+
+func (f *indexFilter) test(key []byte) bool {
+	if _, ok := f.removed[string(key)]; ok {
+		return false
+	}
+	return f.filter.Test(key)
+}
+
+// add adds key to the filter.  A key removed since the filter was built is
+// still in it, and already counted, so is just forgotten from removed.
+func (f *indexFilter) add(key []byte) {
+	if _, ok := f.removed[string(key)]; ok {
+		delete(f.removed, string(key))
+		return
+	}
+	f.filter.Add(key)
+	f.entries++
+}
+
+func (f *indexFilter) remove(key []byte) {
+	f.removed[string(key)] = struct{}{}
+}
+
+func (f *indexFilter) saturated() bool {
+	return f.entries > f.capacity
+}
+
+// stale returns whether enough keys have been removed that the filter should
+// be rebuilt without them.
+func (f *indexFilter) stale() bool {
+	return float64(len(f.removed)) > staleFraction*float64(f.entries)
+}
+
+func (f *indexFilter) stats() FilterStats {
+	// The standard estimate, (1 - e^(-kn/m))^k.
+	k, m, n := float64(f.filter.K()), float64(f.filter.Cap()), float64(f.entries)
+	return FilterStats{
+		Entries:                    f.entries,
+		Capacity:                   f.capacity,
+		Resizes:                    f.resizes,
+		EstimatedFalsePositiveRate: math.Pow(1-math.Exp(-k*n/m), k),
+	}
+}
@@ -1,56 +1,126 @@
 package storage
 
 import (
+	"math"
 	"sort"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
 )
 
 type immutableBlock struct {
-	//from, through int64 // in ms
+	from, through int64 // in us
 
-	traceIDs  map[int64]int
+	traceIDs  map[model.TraceID]int
 	traces    []Trace // sorted by minTimestamp
 	services  []string
 	spanNames map[string][]string
+	tags      map[string][]int // term -> ascending indexes into traces
 }
 
 func newImmutableBlock(b *mutableBlock) *immutableBlock {
-	//from, through := int64(math.MaxInt64), int64(0)
-
 	traces := make([]Trace, 0, len(b.traces))
 	for _, trace := range b.traces {
-		//	from = min(from, trace.MinTimestamp)
-		//	through = max(through, trace.MinTimestamp)
 		traces = append(traces, *trace)
 	}
+	return newImmutableBlockFromTraces(traces)
+}
+
+func newImmutableBlockFromTraces(traces []Trace) *immutableBlock {
+	from, through := int64(math.MaxInt64), int64(math.MinInt64)
 
 	sort.Sort(byMinTimestamp(traces))
-	traceIDs := make(map[int64]int, len(b.traces))
+	traceIDs := make(map[model.TraceID]int, len(traces))
+	servicesSet := map[string]struct{}{}
+	spanNamesSet := map[string]map[string]struct{}{}
+	tags := map[string][]int{}
 	for i, trace := range traces {
+		from = min(from, trace.MinTimestamp)
+		through = max(through, trace.MaxTimestamp)
 		traceIDs[trace.ID] = i
+		for _, span := range trace.Spans {
+			for _, service := range services(span) {
+				servicesSet[service] = struct{}{}
+				if _, ok := spanNamesSet[service]; !ok {
+					spanNamesSet[service] = map[string]struct{}{}
+				}
+				spanNamesSet[service][span.Name] = struct{}{}
+			}
+			for _, term := range spanTerms(span) {
+				if postings := tags[term]; len(postings) == 0 || postings[len(postings)-1] != i {
+					tags[term] = append(postings, i)
+				}
+			}
+		}
 	}
 
-	services := make([]string, 0, len(b.services))
-	for service := range b.services {
+	services := make([]string, 0, len(servicesSet))
+	for service := range servicesSet {
 		services = append(services, service)
 	}
 
-	spanNames := make(map[string][]string, len(b.spanNames))
-	for service := range b.spanNames {
-		names := make([]string, 0, len(b.spanNames[service]))
-		for name := range b.spanNames[service] {
+	spanNames := make(map[string][]string, len(spanNamesSet))
+	for service := range spanNamesSet {
+		names := make([]string, 0, len(spanNamesSet[service]))
+		for name := range spanNamesSet[service] {
 			names = append(names, name)
 		}
 		spanNames[service] = names
 	}
 
 	return &immutableBlock{
+		from:      from,
+		through:   through,
 		traceIDs:  traceIDs,
 		traces:    traces,
 		services:  services,
 		spanNames: spanNames,
+		tags:      tags,
+	}
+}
+
+// expire returns a copy of this block without the traces that finished before
+// cutoffUS, or nil if there would be none left.
+func (s *immutableBlock) expire(cutoffUS int64) (block, error) {
+	traces := make([]Trace, 0, len(s.traces))
+	for _, trace := range s.traces {
+		if trace.MaxTimestamp >= cutoffUS {
+			traces = append(traces, trace)
+		}
+	}
+	switch len(traces) {
+	case 0:
+		return nil, nil
+	case len(s.traces):
+		return s, nil
+	default:
+		return newImmutableBlockFromTraces(traces), nil
 	}
 }
 
+func (s *immutableBlock) allTraces() ([]Trace, error) {
+	return s.traces, nil
+}
+
+func (s *immutableBlock) numTraces() int {
+	return len(s.traces)
+}
+
+func (s *immutableBlock) bounds() (int64, int64) {
+	return s.from, s.through
+}
+
+func (s *immutableBlock) ids() []model.TraceID {
+	ids := make([]model.TraceID, 0, len(s.traces))
+	for _, trace := range s.traces {
+		ids = append(ids, trace.ID)
+	}
+	return ids
+}
+
+func (*immutableBlock) Close() error {
+	return nil
+}
+
 func (s *immutableBlock) Services() ([]string, error) {
 	return s.services, nil
 }
@@ -59,7 +129,7 @@ func (s *immutableBlock) SpanNames(serviceName string) ([]string, error) {
 	return s.spanNames[serviceName], nil
 }
 
-func (s *immutableBlock) Trace(id int64) (Trace, error) {
+func (s *immutableBlock) Trace(id model.TraceID) (Trace, error) {
 	i, ok := s.traceIDs[id]
 	if !ok {
 		return Trace{}, nil
@@ -78,5 +148,17 @@ func (s *immutableBlock) Traces(query Query) ([]Trace, error) {
 	last := sort.Search(len(s.traces), func(i int) bool {
 		return s.traces[i].MinTimestamp > (query.EndMS * 1000)
 	})
-	return s.traces[first:last], nil
+
+	// If the query has tags, only consider traces in the shortest posting list.
+	postings, ok := selectivePostings(s.tags, query.terms())
+	if !ok {
+		return s.traces[first:last], nil
+	}
+	var traces []Trace
+	for _, i := range postings {
+		if i >= first && i < last {
+			traces = append(traces, s.traces[i])
+		}
+	}
+	return traces, nil
 }
@@ -1,36 +1,159 @@
 package storage
 
 import (
+	"os"
+	"path/filepath"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
 )
 
+// numImmutableBlocks is a backstop on memory use when blocks aren't being
+// persisted; normally traces are dropped by retention first.
 const numImmutableBlocks = 1024
 const numMutableTraces = 1024
 
-func NewSpanStore() SpanStore {
-	return &inMemory{
+// The file in cfg.BlocksDir holding the dependency rollups.
+const dependenciesFile = "dependencies.json"
+
+// NewSpanStore makes an in-memory SpanStore, which drops traces older than
+// cfg.Retention.  If cfg.BlocksDir is set, immutable blocks are persisted to
+// files in it, and those files are loaded back in on startup.  If cfg.WALDir
+// is set, spans in the mutable block are logged there, synced every
+// cfg.WALSyncInterval, and replayed on startup, skipping segments already
+// persisted in blocks.  Dependency links are rolled up in the background, as
+// BoltDB does, and kept after the traces are dropped; they're saved in
+// cfg.BlocksDir if it's set.
+func NewSpanStore(cfg Config) (SpanStore, error) {
+	s := &inMemory{
 		mutableBlock: newMutableBlock(),
+		traceIndex:   map[model.TraceID][]block{},
+		dir:          cfg.BlocksDir,
+		walSegments:  map[block]walRange{},
+		persisting:   map[block]struct{}{},
+		compacting:   map[block]struct{}{},
+		rollups:      dependencyRollups{},
+		walSyncer:    startLoop(0, nil),
+	}
+	if s.dir != "" {
+		if err := os.MkdirAll(s.dir, 0777); err != nil {
+			return nil, err
+		}
+		var err error
+		if s.rollups, s.rollupsThrough, err = loadDependencyRollups(filepath.Join(s.dir, dependenciesFile)); err != nil {
+			return nil, err
+		}
+		blocks, err := loadBlockFiles(s.dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range blocks {
+			s.immutableBlocks = append(s.immutableBlocks, b)
+			s.indexBlock(b)
+		}
+		log.Infof("Loaded %d blocks from %s", len(blocks), s.dir)
+	}
+	if cfg.WALDir != "" {
+		var persisted []walRange
+		var last int
+		for _, b := range s.immutableBlocks {
+			if d, ok := b.(*diskBlock); ok && !d.segments.empty() {
+				persisted = append(persisted, d.segments)
+				if d.segments.last > last {
+					last = d.segments.last
+				}
+			}
+		}
+		skip := func(segment int) bool {
+			for _, r := range persisted {
+				if r.covers(segment) {
+					return true
+				}
+			}
+			return false
+		}
+
+		var err error
+		if s.wal, err = openWAL(cfg.WALDir, last); err != nil {
+			return nil, err
+		}
+
+		// Replay everything else into the mutable block, even if that takes
+		// it past numMutableTraces; it'll be promoted on the next Append.
+		var spans int
+		s.mutableWALSegment, err = s.wal.replay(skip, func(span *zipkincore.Span) error {
+			spans++
+			return s.mutableBlock.Append(span)
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Replayed %d spans from WAL", spans)
+
+		s.walSyncer = startLoop(cfg.WALSyncInterval, func() {
+			if err := s.wal.sync(); err != nil {
+				log.Errorf("Error syncing WAL: %v", err)
+			}
+		})
 	}
+	s.retainer = newRetainer(cfg.Retention, s.expire)
+	s.compactor = s.startCompactor()
+	s.rollup = startLoop(dependencyRollupInterval, func() {
+		if err := s.rollUpDependencies(time.Now()); err != nil {
+			log.Errorf("Error rolling up dependencies: %v", err)
+		}
+	})
+	return s, nil
 }
 
 type inMemory struct {
 	mtx             sync.RWMutex
 	mutableBlock    *mutableBlock
-	immutableBlocks []*immutableBlock
+	immutableBlocks []block
+	retainer        *loop
+	compactor       *loop
+	rollup          *loop
+	walSyncer       *loop
+
+	// traceIndex maps trace IDs to the immutable blocks holding their spans.
+	traceIndex map[model.TraceID][]block
+
+	dir      string
+	persists sync.WaitGroup
+
+	// The immutable blocks being written to disk, which retention leaves
+	// alone until persist has swapped them out.
+	persisting map[block]struct{}
+
+	// The immutable blocks being merged by the compactor, which retention
+	// leaves alone for the same reason.
+	compacting map[block]struct{}
+
+	// The first WAL segment holding spans for the mutable block, and the
+	// segments holding each immutable block not yet persisted.
+	wal               *wal
+	mutableWALSegment int
+	walSegments       map[block]walRange
+
+	// Dependency links from the traces which started before rollupsThrough
+	// (in ms).
+	rollups        dependencyRollups
+	rollupsThrough int64
 }
 
 func (s *inMemory) Append(span *zipkincore.Span) error {
 	var err error
 	s.mtx.RLock()
 	size := s.mutableBlock.Size()
-	hasTrace := s.mutableBlock.HasTrace(span.GetTraceID())
+	hasTrace := s.mutableBlock.HasTrace(model.ZipkinTraceID(span))
 	insertIntoMutableBlock := size < numMutableTraces || hasTrace
 	if insertIntoMutableBlock {
-		err = s.mutableBlock.Append(span)
+		err = s.appendMutable(span)
 	}
 	s.mtx.RUnlock()
 
@@ -44,12 +167,197 @@ func (s *inMemory) Append(span *zipkincore.Span) error {
 
 	log.Infof("Mutable block full, promoting - %d mutable traces, %d immutable blocks", size, len(s.immutableBlocks))
 
-	s.immutableBlocks = append(s.immutableBlocks, newImmutableBlock(s.mutableBlock))
+	if err := s.promote(); err != nil {
+		return err
+	}
+	return s.appendMutable(span)
+}
+
+// appendMutable logs the span to the WAL, if there is one, and adds it to the
+// mutable block.  s.mtx must be held.
+func (s *inMemory) appendMutable(span *zipkincore.Span) error {
+	if s.wal != nil {
+		if err := s.wal.log(span); err != nil {
+			return err
+		}
+	}
+	return s.mutableBlock.Append(span)
+}
+
+// promote turns the mutable block into an immutable one, and starts a new
+// mutable block.  s.mtx must be held for writing.
+func (s *inMemory) promote() error {
+	b := newImmutableBlock(s.mutableBlock)
+	s.immutableBlocks = append(s.immutableBlocks, b)
+	s.indexBlock(b)
+	s.mutableBlock = newMutableBlock()
+
+	if s.wal != nil {
+		segment, err := s.wal.cut()
+		if err != nil {
+			return err
+		}
+		s.walSegments[b] = walRange{first: s.mutableWALSegment, last: segment - 1}
+		s.mutableWALSegment = segment
+	}
+
+	if s.dir != "" {
+		s.persisting[b] = struct{}{}
+		s.persists.Add(1)
+		go func() {
+			defer s.persists.Done()
+			if err := s.persist(b); err != nil {
+				log.Errorf("Error persisting block: %v", err)
+			}
+			s.mtx.Lock()
+			delete(s.persisting, b)
+			s.mtx.Unlock()
+		}()
+		return nil
+	}
+
+	// Without persistence, immutable blocks are lost on restart anyway, so
+	// there's no point keeping their WAL segments.
+	delete(s.walSegments, b)
 	if len(s.immutableBlocks) > numImmutableBlocks {
+		s.unindexBlock(s.immutableBlocks[0])
+		dropBlock(s.immutableBlocks[0])
 		s.immutableBlocks = s.immutableBlocks[1:]
 	}
-	s.mutableBlock = newMutableBlock()
-	return s.mutableBlock.Append(span)
+	return s.truncateWAL()
+}
+
+// truncateWAL deletes the WAL segments which only contain spans that are now
+// in persisted blocks.  s.mtx must be held for writing.
+func (s *inMemory) truncateWAL() error {
+	if s.wal == nil {
+		return nil
+	}
+	segment := s.mutableWALSegment
+	for _, segments := range s.walSegments {
+		if segments.first < segment {
+			segment = segments.first
+		}
+	}
+	return s.wal.truncate(segment)
+}
+
+// persist writes an in-memory block to disk, and then swaps it for the
+// memory-mapped copy.  The file records the block's WAL segments, which
+// aren't replayed on startup even if an older block still being persisted
+// keeps them from being truncated.
+func (s *inMemory) persist(b block) error {
+	s.mtx.RLock()
+	segments := s.walSegments[b]
+	s.mtx.RUnlock()
+
+	path, err := writeBlockFile(s.dir, b, segments)
+	if err != nil {
+		return err
+	}
+	d, err := openBlockFile(path)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.walSegments, b)
+	for i := range s.immutableBlocks {
+		if s.immutableBlocks[i] == b {
+			s.immutableBlocks[i] = d
+			s.unindexBlock(b)
+			s.indexBlock(d)
+			return s.truncateWAL()
+		}
+	}
+
+	// The block was expired whilst we were writing it.
+	if err := dropBlock(d); err != nil {
+		return err
+	}
+	return s.truncateWAL()
+}
+
+// Close persists any blocks still in memory, including the mutable block, so
+// nothing is lost on a clean shutdown.
+func (s *inMemory) Close() error {
+	s.retainer.Stop()
+	s.compactor.Stop()
+	s.rollup.Stop()
+	s.walSyncer.Stop()
+
+	s.mtx.Lock()
+	if s.dir != "" && s.mutableBlock.Size() > 0 {
+		if err := s.promote(); err != nil {
+			s.mtx.Unlock()
+			return err
+		}
+	}
+	s.mtx.Unlock()
+	s.persists.Wait()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, b := range s.immutableBlocks {
+		if err := b.Close(); err != nil {
+			return err
+		}
+	}
+	s.immutableBlocks = nil
+	s.traceIndex = map[model.TraceID][]block{}
+	if s.wal != nil {
+		return s.wal.Close()
+	}
+	return nil
+}
+
+// expire drops traces that finished before cutoffUS.  Blocks still being
+// persisted or compacted are expired once that's done; any other block
+// replaced by an expired copy hands its WAL segments on to the copy.
+func (s *inMemory) expire(cutoffUS int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.mutableBlock.expire(cutoffUS)
+
+	immutableBlocks := make([]block, 0, len(s.immutableBlocks))
+	for _, b := range s.immutableBlocks {
+		_, persisting := s.persisting[b]
+		_, compacting := s.compacting[b]
+		if persisting || compacting {
+			immutableBlocks = append(immutableBlocks, b)
+			continue
+		}
+		expired, err := b.expire(cutoffUS)
+		if err != nil {
+			return err
+		}
+		if expired == b {
+			immutableBlocks = append(immutableBlocks, b)
+			continue
+		}
+		s.unindexBlock(b)
+		if segments, ok := s.walSegments[b]; ok {
+			delete(s.walSegments, b)
+			if expired != nil {
+				s.walSegments[expired] = segments
+			}
+		}
+		if expired == nil {
+			if err := dropBlock(b); err != nil {
+				return err
+			}
+			continue
+		}
+		s.indexBlock(expired)
+		immutableBlocks = append(immutableBlocks, expired)
+	}
+	if dropped := len(s.immutableBlocks) - len(immutableBlocks); dropped > 0 {
+		log.Infof("Retention dropped %d immutable blocks", dropped)
+	}
+	s.immutableBlocks = immutableBlocks
+	return s.truncateWAL()
 }
 
 func (s *inMemory) stores(f func(ReadStore) error) error {
@@ -88,19 +396,70 @@ func (s *inMemory) SpanNames(serviceName string) ([]string, error) {
 	return mergeStringListList(result), err
 }
 
-func (s *inMemory) Trace(id int64) (Trace, error) {
+// Trace looks the trace up in the mutable block, and in the immutable blocks
+// the trace index says hold it.
+func (s *inMemory) Trace(id model.TraceID) (Trace, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.trace(id)
+}
+
+// trace reads a whole trace.  s.mtx must be held.
+func (s *inMemory) trace(id model.TraceID) (Trace, error) {
 	var result []Trace
-	err := s.stores(func(s ReadStore) error {
-		trace, err := s.Trace(id)
+	trace, err := s.mutableBlock.Trace(id)
+	if err != nil {
+		return Trace{}, err
+	}
+	if len(trace.Spans) > 0 {
 		result = append(result, trace)
-		return err
-	})
-	return mergeTraceList(result), err
+	}
+	for _, b := range s.traceIndex[id] {
+		trace, err := b.Trace(id)
+		if err != nil {
+			return Trace{}, err
+		}
+		result = append(result, trace)
+	}
+	if len(result) == 0 {
+		return Trace{}, ErrNotFound
+	}
+	return mergeTraceList(result), nil
+}
+
+// indexBlock adds a block's traces to the trace index.  s.mtx must be held
+// for writing.
+func (s *inMemory) indexBlock(b block) {
+	for _, id := range b.ids() {
+		s.traceIndex[id] = append(s.traceIndex[id], b)
+	}
+}
+
+// unindexBlock removes a block's traces from the trace index.  s.mtx must be
+// held for writing.
+func (s *inMemory) unindexBlock(b block) {
+	for _, id := range b.ids() {
+		blocks := s.traceIndex[id]
+		for i := range blocks {
+			if blocks[i] == b {
+				blocks = append(blocks[:i:i], blocks[i+1:]...)
+				break
+			}
+		}
+		if len(blocks) == 0 {
+			delete(s.traceIndex, id)
+		} else {
+			s.traceIndex[id] = blocks
+		}
+	}
 }
 
 func (s *inMemory) Traces(query Query) ([]Trace, error) {
 	var result [][]Trace
 	err := s.stores(func(s ReadStore) error {
+		if b, ok := s.(block); ok && !overlaps(b, query) {
+			return nil
+		}
 		traces, err := s.Traces(query)
 		result = append(result, traces)
 		return err
@@ -109,11 +468,111 @@ func (s *inMemory) Traces(query Query) ([]Trace, error) {
 		return nil, err
 	}
 	traces := mergeTraceListList(result)
+
+	// traces is oldest first.  Stop as soon as we have enough candidates.
 	filtered := make([]Trace, 0, query.Limit)
-	for i := len(traces) - 1; i >= 0 && len(filtered) < query.Limit; i-- {
-		if traces[i].match(query) {
-			filtered = append(filtered, traces[i])
+	for i := range traces {
+		if len(filtered) >= query.candidates() {
+			break
+		}
+		trace := traces[len(traces)-1-i]
+		if query.Sort == SortOldest {
+			trace = traces[i]
+		}
+		if trace.match(query) {
+			filtered = append(filtered, trace)
+		}
+	}
+	if !query.Sort.byTime() {
+		sortTraces(filtered, query.Sort)
+		if len(filtered) > query.Limit {
+			filtered = filtered[:query.Limit]
 		}
 	}
 	return filtered, nil
 }
+
+// rollUpDependencies rolls up the dependency links from each period which
+// ended dependencyRollupDelay ago, so late spans are included, and saves them
+// if blocks are being persisted.
+func (s *inMemory) rollUpDependencies(now time.Time) error {
+	complete := dependencyPeriod(now.Add(-dependencyRollupDelay).UnixNano() / int64(time.Millisecond))
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.rollupsThrough >= complete {
+		return nil
+	}
+	traces, err := s.tracesStarting(s.rollupsThrough, complete)
+	if err != nil {
+		return err
+	}
+	for i := range traces {
+		s.rollups.addTrace(&traces[i])
+	}
+	s.rollupsThrough = complete
+	if s.dir == "" {
+		return nil
+	}
+	return s.rollups.save(filepath.Join(s.dir, dependenciesFile), s.rollupsThrough)
+}
+
+// tracesStarting returns the traces which started between startMS
+// (inclusive) and endMS (exclusive).  They're found in the blocks overlapping
+// that window, but read whole through the trace index, so traces split
+// between blocks keep all their links.  s.mtx must be held.
+func (s *inMemory) tracesStarting(startMS, endMS int64) ([]Trace, error) {
+	query := Query{StartMS: startMS, EndMS: endMS}
+	stores := []ReadStore{s.mutableBlock}
+	for _, b := range s.immutableBlocks {
+		if overlaps(b, query) {
+			stores = append(stores, b)
+		}
+	}
+	ids := map[model.TraceID]struct{}{}
+	for _, store := range stores {
+		pieces, err := store.Traces(query)
+		if err != nil {
+			return nil, err
+		}
+		for _, piece := range pieces {
+			ids[piece.ID] = struct{}{}
+		}
+	}
+
+	var traces []Trace
+	for id := range ids {
+		trace, err := s.trace(id)
+		if err != nil {
+			return nil, err
+		}
+		if start := trace.MinTimestamp / 1000; start >= startMS && start < endMS {
+			traces = append(traces, trace)
+		}
+	}
+	return traces, nil
+}
+
+// Dependencies combines the rollups with links from the traces which started
+// after the last rollup.  Rollups cover whole periods, so may include links
+// from just outside the window.
+func (s *inMemory) Dependencies(startMS, endMS int64) ([]DependencyLink, error) {
+	linker := newDependencyLinker()
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	s.rollups.addTo(linker, startMS, endMS)
+	if s.rollupsThrough > endMS {
+		return linker.result(), nil
+	}
+	if s.rollupsThrough > startMS {
+		startMS = s.rollupsThrough
+	}
+	traces, err := s.tracesStarting(startMS, endMS+1)
+	if err != nil {
+		return nil, err
+	}
+	for i := range traces {
+		linker.addTrace(&traces[i])
+	}
+	return linker.result(), nil
+}
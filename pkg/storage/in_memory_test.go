@@ -0,0 +1,374 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
+)
+
+func TestInMemoryExpire(t *testing.T) {
+	s, err := NewSpanStore(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := s.(*inMemory)
+	defer store.Close()
+
+	// Enough traces to fill the mutable block and promote it.
+	for i := int64(1); i <= numMutableTraces+2; i++ {
+		if err := store.Append(newTestSpan(i, i, i*1000000, "foo", "get")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, have := 1, len(store.immutableBlocks); want != have {
+		t.Fatalf("expected %d immutable blocks, got %d", want, have)
+	}
+
+	if err := store.expire((numMutableTraces + 2) * 1000000); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0, len(store.immutableBlocks); want != have {
+		t.Fatalf("expected %d immutable blocks, got %d", want, have)
+	}
+
+	traces, err := store.Traces(Query{StartMS: 0, EndMS: 1 << 40, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []int64{numMutableTraces + 2}, traceIDs(traces); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", diff(want, have))
+	}
+}
+
+func TestInMemoryExpireWhilstPersisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpanStore(Config{BlocksDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := s.(*inMemory)
+	defer store.Close()
+
+	// A block promoted but not yet written, with one trace retention drops.
+	b := newImmutableBlockFromTraces([]Trace{
+		*newTrace(newTestSpan(1, 1, 1000000, "foo", "get")),
+		*newTrace(newTestSpan(2, 2, 5000000, "foo", "get")),
+	})
+	store.immutableBlocks = append(store.immutableBlocks, b)
+	store.indexBlock(b)
+	store.persisting[b] = struct{}{}
+
+	if err := store.expire(2000000); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.immutableBlocks) != 1 || store.immutableBlocks[0] != block(b) {
+		t.Fatalf("expected the persisting block to be kept, got %v", store.immutableBlocks)
+	}
+	if err := store.persist(b); err != nil {
+		t.Fatal(err)
+	}
+	delete(store.persisting, b)
+	if _, ok := store.immutableBlocks[0].(*diskBlock); !ok {
+		t.Fatalf("expected a disk block, got %T", store.immutableBlocks[0])
+	}
+
+	traces, err := store.Traces(Query{StartMS: 0, EndMS: 1 << 40, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []int64{2, 1}, traceIDs(traces); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", diff(want, have))
+	}
+
+	// Once on disk, the block is expired as a whole.
+	if err := store.expire(6000000); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0, len(store.immutableBlocks); want != have {
+		t.Fatalf("expected %d immutable blocks, got %d", want, have)
+	}
+}
+
+func TestInMemoryPersistBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpanStore(Config{BlocksDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= numMutableTraces+2; i++ {
+		if err := s.Append(newTestSpan(i, i, i*1000000, "foo", "get")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewSpanStore(Config{BlocksDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	store := s.(*inMemory)
+	if want, have := 2, len(store.immutableBlocks); want != have {
+		t.Fatalf("expected %d immutable blocks, got %d", want, have)
+	}
+	for _, b := range store.immutableBlocks {
+		if _, ok := b.(*diskBlock); !ok {
+			t.Fatalf("expected a disk block, got %T", b)
+		}
+	}
+
+	trace, err := s.Trace(model.TraceID{Low: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := newTestSpan(7, 7, 7000000, "foo", "get"); len(trace.Spans) != 1 || !reflect.DeepEqual(want, trace.Spans[0]) {
+		t.Fatalf("%s", diff(want, trace.Spans))
+	}
+
+	traces, err := s.Traces(Query{ServiceName: "foo", StartMS: 0, EndMS: 1 << 40, Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []int64{numMutableTraces + 2, numMutableTraces + 1, numMutableTraces}, traceIDs(traces); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", diff(want, have))
+	}
+
+	names, err := s.SpanNames("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"get"}; !reflect.DeepEqual(want, names) {
+		t.Fatalf("%s", diff(want, names))
+	}
+}
+
+func TestInMemoryWALReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := Config{WALDir: dir, WALSyncInterval: time.Millisecond}
+
+	s, err := NewSpanStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*zipkincore.Span{
+		newTestSpan(1, 1, 1000000, "foo", "get"),
+		newTestSpan(1, 2, 1000005, "bar", "put"),
+	}
+	for _, span := range want {
+		if err := s.Append(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate a crash by not closing the store.
+	s, err = NewSpanStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace, err := s.Trace(model.TraceID{Low: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, trace.Spans) {
+		t.Fatalf("%s", diff(want, trace.Spans))
+	}
+
+	// Promoting the mutable block, without persistence, truncates the WAL.
+	for i := int64(2); i <= numMutableTraces+1; i++ {
+		if err := s.Append(newTestSpan(i, i, i*1000000, "foo", "get")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewSpanStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	traces, err := s.Traces(Query{StartMS: 0, EndMS: 1 << 40, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []int64{numMutableTraces + 1}, traceIDs(traces); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", diff(want, have))
+	}
+}
+
+func TestInMemoryWALReplaySkipsPersistedBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := Config{WALDir: filepath.Join(dir, "wal"), BlocksDir: filepath.Join(dir, "blocks")}
+
+	s, err := NewSpanStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*zipkincore.Span{
+		newTestSpan(1, 1, 1000000, "foo", "get"),
+		newTestSpan(1, 2, 1000005, "bar", "put"),
+	}
+	for _, span := range want {
+		if err := s.Append(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate a crash after persisting the spans' block, but before
+	// truncating the WAL segment holding them.
+	persisted := newTrace(want[0])
+	persisted.addSpan(want[1])
+	b := newImmutableBlockFromTraces([]Trace{*persisted})
+	if _, err := writeBlockFile(cfg.BlocksDir, b, walRange{first: 1, last: 1}); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewSpanStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	trace, err := s.Trace(model.TraceID{Low: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, trace.Spans) {
+		t.Fatalf("%s", diff(want, trace.Spans))
+	}
+	if want, have := 2, s.(*inMemory).wal.segment; want != have {
+		t.Fatalf("expected segment %d, got %d", want, have)
+	}
+}
+
+func TestBlockBounds(t *testing.T) {
+	b := newImmutableBlockFromTraces([]Trace{
+		*newTrace(newTestSpan(1, 1, 1000000, "foo", "get")),
+		*newTrace(newTestSpan(2, 2, 5000000, "foo", "get")),
+	})
+
+	if from, through := b.bounds(); from != 1000000 || through != 5000010 {
+		t.Fatalf("unexpected bounds: %d, %d", from, through)
+	}
+	for _, tc := range []struct {
+		query Query
+		want  bool
+	}{
+		{Query{StartMS: 0, EndMS: 999}, false},
+		{Query{StartMS: 0, EndMS: 1000}, true},
+		{Query{StartMS: 3000, EndMS: 4000}, true},
+		{Query{StartMS: 5000, EndMS: 6000}, true},
+		{Query{StartMS: 5001, EndMS: 6000}, false},
+	} {
+		if have := overlaps(b, tc.query); tc.want != have {
+			t.Errorf("overlaps(%+v): want %v, have %v", tc.query, tc.want, have)
+		}
+	}
+}
+
+func TestInMemoryTraceIndex(t *testing.T) {
+	s, err := NewSpanStore(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	store := s.(*inMemory)
+
+	// Trace 1 ends up split between an immutable block and the mutable block.
+	if err := store.Append(newTestSpan(1, 1, 1000000, "foo", "get")); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(2); i <= numMutableTraces+1; i++ {
+		if err := store.Append(newTestSpan(i, i, i*1000000, "foo", "get")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Append(newTestSpan(1, 0, 1000005, "bar", "put")); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := 1, len(store.traceIndex[model.TraceID{Low: 1}]); want != have {
+		t.Fatalf("expected trace to be in %d blocks, got %d", want, have)
+	}
+	trace, err := store.Trace(model.TraceID{Low: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(trace.Spans); want != have {
+		t.Fatalf("expected %d spans, got %d", want, have)
+	}
+
+	if _, err := store.Trace(model.TraceID{Low: numMutableTraces + 100}); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestInMemoryResentSpans(t *testing.T) {
+	s, err := NewSpanStore(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	store := s.(*inMemory)
+
+	// A scraper resends spans it couldn't acknowledge, both to the block
+	// which holds them and, once that's been promoted, to the next one.
+	client := newTestSpan(1, 1, 1000000, "foo", "get")
+	server := newTestSpan(1, 1, 1000000, "bar", "get")
+	for _, span := range []*zipkincore.Span{client, client, server} {
+		if err := store.Append(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.mtx.Lock()
+	err = store.promote()
+	store.mtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, span := range []*zipkincore.Span{client, server} {
+		if err := store.Append(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	trace, err := store.Trace(model.TraceID{Low: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(trace.Spans); want != have {
+		t.Fatalf("expected %d spans, got %d", want, have)
+	}
+	traces, err := store.Traces(Query{EndMS: 2000, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 || len(traces[0].Spans) != 2 {
+		t.Fatalf("expected one trace of 2 spans, got %v", traces)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"sort"
 
 	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
 )
 
 func mergeStringLists(a, b []string) []string {
@@ -54,11 +56,14 @@ func mergeStringListList(ss [][]string) []string {
 	}
 }
 
-// mergeTraceList merges a list of traces into a single trace.  They must all
-// have the same traceID.
+// mergeTraceList merges a list of traces into a single trace, dropping spans
+// which were appended more than once.  They must all have the same traceID.
 func mergeTraceList(input []Trace) Trace {
-	if len(input) == 0 {
-		panic("Cannot merge zero-length list!")
+	switch len(input) {
+	case 0:
+		return Trace{}
+	case 1:
+		return input[0]
 	}
 
 	spans := []*zipkincore.Span{}
@@ -73,19 +78,20 @@ func mergeTraceList(input []Trace) Trace {
 			maxTimestamp = trace.MaxTimestamp
 		}
 	}
+	sort.Sort(byTimestamp(spans))
 
 	return Trace{
 		ID:           input[0].ID,
 		MinTimestamp: minTimestamp,
 		MaxTimestamp: maxTimestamp,
-		Spans:        spans,
+		Spans:        uniqueSpans(spans),
 	}
 }
 
 // mergeTraceListList merges a list of lists traces.  It assumes traces within
 // each inner-list do not overlap.
 func mergeTraceListList(input [][]Trace) []Trace {
-	traces := map[int64][]Trace{}
+	traces := map[model.TraceID][]Trace{}
 	for _, traceList := range input {
 		for _, trace := range traceList {
 			id := trace.ID
@@ -4,20 +4,24 @@ import (
 	"sync"
 
 	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
 )
 
 type mutableBlock struct {
 	mtx       sync.RWMutex
-	traces    map[int64]*Trace
+	traces    map[model.TraceID]*Trace
 	services  map[string]struct{}
 	spanNames map[string]map[string]struct{}
+	tags      map[string]map[model.TraceID]struct{} // term -> trace IDs
 }
 
 func newMutableBlock() *mutableBlock {
 	return &mutableBlock{
-		traces:    make(map[int64]*Trace, numMutableTraces),
+		traces:    make(map[model.TraceID]*Trace, numMutableTraces),
 		services:  map[string]struct{}{},
 		spanNames: map[string]map[string]struct{}{},
+		tags:      map[string]map[model.TraceID]struct{}{},
 	}
 }
 
@@ -27,7 +31,7 @@ func (s *mutableBlock) Size() int {
 	return len(s.traces)
 }
 
-func (s *mutableBlock) HasTrace(id int64) bool {
+func (s *mutableBlock) HasTrace(id model.TraceID) bool {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 	_, ok := s.traces[id]
@@ -38,36 +42,72 @@ func (s *mutableBlock) Append(span *zipkincore.Span) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	traceID := span.GetTraceID()
+	traceID := model.ZipkinTraceID(span)
 
 	t, ok := s.traces[traceID]
 	if ok {
+		if t.hasSpan(span) {
+			return nil
+		}
 		t.addSpan(span)
 	} else {
 		t = newTrace(span)
 		s.traces[traceID] = t
 	}
 
+	s.index(span)
+	return nil
+}
+
+func (s *mutableBlock) index(span *zipkincore.Span) {
 	// update services 'index'
-	services := map[string]struct{}{}
-	for _, annotation := range span.Annotations {
-		s.services[annotation.Host.ServiceName] = struct{}{}
-		services[annotation.Host.ServiceName] = struct{}{}
-	}
-	for _, annotation := range span.BinaryAnnotations {
-		s.services[annotation.Host.ServiceName] = struct{}{}
-		services[annotation.Host.ServiceName] = struct{}{}
+	services := services(span)
+	for _, service := range services {
+		s.services[service] = struct{}{}
 	}
 
 	// update spanNames 'index'
-	for service := range services {
+	for _, service := range services {
 		if _, ok := s.spanNames[service]; !ok {
 			s.spanNames[service] = map[string]struct{}{}
 		}
 		s.spanNames[service][span.Name] = struct{}{}
 	}
 
-	return nil
+	// update tags 'index'
+	for _, term := range spanTerms(span) {
+		if _, ok := s.tags[term]; !ok {
+			s.tags[term] = map[model.TraceID]struct{}{}
+		}
+		s.tags[term][model.ZipkinTraceID(span)] = struct{}{}
+	}
+}
+
+// expire drops traces that finished before cutoffUS, and rebuilds the indexes
+// if any were dropped.
+func (s *mutableBlock) expire(cutoffUS int64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	expired := false
+	for id, trace := range s.traces {
+		if trace.MaxTimestamp < cutoffUS {
+			delete(s.traces, id)
+			expired = true
+		}
+	}
+	if !expired {
+		return
+	}
+
+	s.services = map[string]struct{}{}
+	s.spanNames = map[string]map[string]struct{}{}
+	s.tags = map[string]map[model.TraceID]struct{}{}
+	for _, trace := range s.traces {
+		for _, span := range trace.Spans {
+			s.index(span)
+		}
+	}
 }
 
 func (s *mutableBlock) Services() ([]string, error) {
@@ -94,7 +134,7 @@ func (s *mutableBlock) SpanNames(serviceName string) ([]string, error) {
 	return result, nil
 }
 
-func (s *mutableBlock) Trace(id int64) (Trace, error) {
+func (s *mutableBlock) Trace(id model.TraceID) (Trace, error) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
@@ -109,9 +149,29 @@ func (s *mutableBlock) Traces(query Query) ([]Trace, error) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
+	inRange := func(trace *Trace) bool {
+		return trace.MaxTimestamp >= (query.StartMS*1000) && trace.MinTimestamp < (query.EndMS*1000)
+	}
+
 	traces := []Trace{}
+	if terms := query.terms(); len(terms) > 0 {
+		// Only consider traces which have the rarest of the query's terms.
+		var ids map[model.TraceID]struct{}
+		for i, term := range terms {
+			if i == 0 || len(s.tags[term]) < len(ids) {
+				ids = s.tags[term]
+			}
+		}
+		for id := range ids {
+			if trace := s.traces[id]; inRange(trace) {
+				traces = append(traces, *trace)
+			}
+		}
+		return traces, nil
+	}
+
 	for _, trace := range s.traces {
-		if trace.MaxTimestamp >= (query.StartMS*1000) && trace.MinTimestamp < (query.EndMS*1000) {
+		if inRange(trace) {
 			traces = append(traces, *trace)
 		}
 	}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often stores look for data that has passed the retention period.
+const retentionInterval = time.Minute
+
+// loop calls a function periodically in the background, until stopped.
+type loop struct {
+	quit chan struct{}
+	stop sync.Once
+	wg   sync.WaitGroup
+}
+
+// startLoop calls f every interval.  A zero interval never calls f.
+func startLoop(interval time.Duration, f func()) *loop {
+	l := &loop{
+		quit: make(chan struct{}),
+	}
+	if interval <= 0 {
+		return l
+	}
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f()
+			case <-l.quit:
+				return
+			}
+		}
+	}()
+	return l
+}
+
+func (l *loop) Stop() {
+	l.stop.Do(func() { close(l.quit) })
+	l.wg.Wait()
+}
+
+// newRetainer starts calling expire with the cutoff (in microseconds) every
+// retentionInterval.  A zero retention keeps data forever.
+func newRetainer(retention time.Duration, expire func(cutoffUS int64) error) *loop {
+	if retention <= 0 {
+		return startLoop(0, nil)
+	}
+	return startLoop(retentionInterval, func() {
+		if err := expire(retentionCutoff(time.Now(), retention)); err != nil {
+			log.Errorf("Error applying retention: %v", err)
+		}
+	})
+}
+
+// retentionCutoff returns the timestamp, in microseconds, before which data
+// should be deleted.
+func retentionCutoff(now time.Time, retention time.Duration) int64 {
+	return now.Add(-retention).UnixNano() / int64(time.Microsecond)
+}
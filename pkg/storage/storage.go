@@ -1,18 +1,33 @@
 package storage
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
 	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
 )
 
+// ErrNotFound is returned by ReadStore.Trace when there is no such trace.
+var ErrNotFound = errors.New("trace not found")
+
 type SpanStore interface {
 	Append(*zipkincore.Span) error
+	Close() error
 	ReadStore
+
+	// Dependencies returns the calls between services in traces between
+	// startMS and endMS.
+	Dependencies(startMS, endMS int64) ([]DependencyLink, error)
 }
 
 type ReadStore interface {
 	Services() ([]string, error)
 	SpanNames(serviceName string) ([]string, error)
-	Trace(id int64) (Trace, error)
+	Trace(id model.TraceID) (Trace, error)
 	Traces(query Query) ([]Trace, error)
 }
 
@@ -20,8 +35,91 @@ type Query struct {
 	ServiceName   string
 	SpanName      string
 	MinDurationUS int64
-	MaxDurationUS int64
+	MaxDurationUS int64 // 0 means no maximum
 	EndMS         int64
 	StartMS       int64
 	Limit         int
+	Sort          SortOrder
+
+	// Annotations are annotation values or tag keys which matching traces
+	// must have, and BinaryAnnotations are tag values they must have.
+	Annotations       []string
+	BinaryAnnotations map[string]string
+}
+
+// SortOrder is the order in which Traces returns matching traces.
+type SortOrder string
+
+// The zero SortOrder is SortNewest.  The duration orders can't stop at the
+// first Limit traces found, so they choose from the newest maxSortCandidates
+// matching traces in the window instead of reading every trace in it.
+const (
+	SortNewest   SortOrder = "newest"
+	SortOldest   SortOrder = "oldest"
+	SortLongest  SortOrder = "longest"
+	SortShortest SortOrder = "shortest"
+)
+
+var maxSortCandidates = 10000
+
+// ParseSortOrder parses a SortOrder; the empty string means SortNewest.
+func ParseSortOrder(s string) (SortOrder, error) {
+	switch order := SortOrder(s); order {
+	case "":
+		return SortNewest, nil
+	case SortNewest, SortOldest, SortLongest, SortShortest:
+		return order, nil
+	default:
+		return "", fmt.Errorf("unknown sort order %q", s)
+	}
+}
+
+// byTime returns whether the order is by timestamp, in which case stores can
+// stop looking once they have found Limit traces.
+func (o SortOrder) byTime() bool {
+	return o == "" || o == SortNewest || o == SortOldest
+}
+
+// candidates returns how many matching traces a store needs to find, walking
+// newest first unless the order is SortOldest, before it can stop looking.
+func (q Query) candidates() int {
+	if q.Sort.byTime() || q.Limit > maxSortCandidates {
+		return q.Limit
+	}
+	return maxSortCandidates
+}
+
+// Config selects and configures the SpanStore backend.
+type Config struct {
+	Type      string
+	Path      string
+	Retention time.Duration
+	BlocksDir string
+	WALDir    string
+
+	// WALSyncInterval is how often the WAL is synced to disk.  Spans logged
+	// since the last sync survive the process crashing, but not the machine.
+	WALSyncInterval time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Type, "storage.type", "memory", "Which storage backend to use (memory or boltdb).")
+	f.StringVar(&cfg.Path, "storage.path", "traces.db", "Path to the database file, for on-disk storage backends.")
+	f.StringVar(&cfg.BlocksDir, "storage.blocks-dir", "", "Directory to persist in-memory blocks to; empty means don't persist them.")
+	f.StringVar(&cfg.WALDir, "storage.wal-dir", "", "Directory for the in-memory store's write-ahead log; empty disables it.")
+	f.DurationVar(&cfg.WALSyncInterval, "storage.wal-sync-interval", time.Second, "How often to sync the write-ahead log to disk; 0 only syncs it when a segment is cut.")
+	f.DurationVar(&cfg.Retention, "storage.retention", 72*time.Hour, "How long to keep traces for; 0 keeps them forever.")
+}
+
+// New makes a SpanStore of the type given in the config.
+func New(cfg Config) (SpanStore, error) {
+	switch cfg.Type {
+	case "memory":
+		return NewSpanStore(cfg)
+	case "boltdb":
+		return NewBoltDBSpanStore(cfg.Path, cfg.Retention)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+	}
 }
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+)
+
+// Tags (binary annotations) and annotations are indexed as terms.  A span
+// has a term for each annotation value, each tag key, and each tag key=value
+// pair, mirroring Zipkin's annotationQuery, where "error" matches either an
+// annotation or a tag called error, and "http.status_code=500" matches a tag
+// value.  As in Zipkin, a trace matches if a single span, recorded by the
+// queried service, has every term.
+
+// spanTerms returns the index terms for a span.
+func spanTerms(span *zipkincore.Span) []string {
+	terms := map[string]struct{}{}
+	for _, annotation := range span.Annotations {
+		terms[annotation.Value] = struct{}{}
+	}
+	for _, annotation := range span.BinaryAnnotations {
+		terms[annotation.Key] = struct{}{}
+		if value, ok := binaryAnnotationValue(annotation); ok {
+			terms[annotation.Key+"="+value] = struct{}{}
+		}
+	}
+	result := make([]string, 0, len(terms))
+	for term := range terms {
+		result = append(result, term)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// binaryAnnotationValue formats a binary annotation's value as a string, or
+// returns false if it has no meaningful string form.
+func binaryAnnotationValue(annotation *zipkincore.BinaryAnnotation) (string, bool) {
+	value := annotation.Value
+	switch annotation.AnnotationType {
+	case zipkincore.AnnotationType_BOOL:
+		return strconv.FormatBool(len(value) > 0 && value[0] == '\x01'), true
+	case zipkincore.AnnotationType_STRING:
+		return string(value), true
+	case zipkincore.AnnotationType_I16:
+		if len(value) == 2 {
+			return strconv.FormatInt(int64(int16(binary.BigEndian.Uint16(value))), 10), true
+		}
+	case zipkincore.AnnotationType_I32:
+		if len(value) == 4 {
+			return strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(value))), 10), true
+		}
+	case zipkincore.AnnotationType_I64:
+		if len(value) == 8 {
+			return strconv.FormatInt(int64(binary.BigEndian.Uint64(value)), 10), true
+		}
+	case zipkincore.AnnotationType_DOUBLE:
+		if len(value) == 8 {
+			return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(value)), 'g', -1, 64), true
+		}
+	}
+	return "", false
+}
+
+// terms returns the index terms a trace must have to match the query.
+func (q Query) terms() []string {
+	terms := make([]string, 0, len(q.Annotations)+len(q.BinaryAnnotations))
+	terms = append(terms, q.Annotations...)
+	for key, value := range q.BinaryAnnotations {
+		terms = append(terms, key+"="+value)
+	}
+	sort.Strings(terms)
+	return terms
+}
+
+// hasTerms returns whether one of the trace's spans has all of the given
+// terms, and was recorded by serviceName if it's set.
+func (t *Trace) hasTerms(serviceName string, terms []string) bool {
+	if len(terms) == 0 {
+		return true
+	}
+	for _, span := range t.Spans {
+		if serviceName != "" && !hasService(span, serviceName) {
+			continue
+		}
+		have := map[string]struct{}{}
+		for _, term := range spanTerms(span) {
+			have[term] = struct{}{}
+		}
+		found := true
+		for _, term := range terms {
+			if _, ok := have[term]; !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func hasService(span *zipkincore.Span, serviceName string) bool {
+	for _, service := range services(span) {
+		if service == serviceName {
+			return true
+		}
+	}
+	return false
+}
+
+// selectivePostings returns the shortest of the posting lists for the terms,
+// as that gives the fewest candidates to check.  ok is false if there are no
+// terms.
+func selectivePostings(postings map[string][]int, terms []string) (result []int, ok bool) {
+	for i, term := range terms {
+		p := postings[term]
+		if i == 0 || len(p) < len(result) {
+			result = p
+		}
+	}
+	return result, len(terms) > 0
+}
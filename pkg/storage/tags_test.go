@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+)
+
+// newTaggedTestSpan returns a test span where even traces have
+// http.status_code=500 and every third trace has an error annotation.
+func newTaggedTestSpan(i int64) *zipkincore.Span {
+	span := newTestSpan(i, i, i*1000000, "foo", "get")
+	host := span.Annotations[0].Host
+	if i%2 == 0 {
+		span.BinaryAnnotations = append(span.BinaryAnnotations, &zipkincore.BinaryAnnotation{
+			Key:            "http.status_code",
+			Value:          []byte("500"),
+			AnnotationType: zipkincore.AnnotationType_STRING,
+			Host:           host,
+		})
+	}
+	if i%3 == 0 {
+		span.Annotations = append(span.Annotations, &zipkincore.Annotation{
+			Timestamp: i * 1000000,
+			Value:     "error",
+			Host:      host,
+		})
+	}
+	return span
+}
+
+func testTagQueries(t *testing.T, store ReadStore) {
+	for _, tc := range []struct {
+		query Query
+		want  []int64
+	}{
+		{Query{Annotations: []string{"error"}}, []int64{12, 9, 6, 3}},
+		{Query{BinaryAnnotations: map[string]string{"http.status_code": "500"}}, []int64{12, 10, 8, 6, 4, 2}},
+		{Query{Annotations: []string{"http.status_code", "error"}}, []int64{12, 6}},
+		{Query{BinaryAnnotations: map[string]string{"http.status_code": "404"}}, []int64{}},
+	} {
+		tc.query.ServiceName, tc.query.StartMS, tc.query.EndMS, tc.query.Limit = "foo", 0, 1<<40, 10
+		traces, err := store.Traces(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := traceIDs(traces); !reflect.DeepEqual(tc.want, have) {
+			t.Fatalf("%+v: %s", tc.query, diff(tc.want, have))
+		}
+	}
+}
+
+// testSpanTagQueries checks terms must all be on one span of the queried
+// service, using a trace where web calls db, and web's span has the error.
+func testSpanTagQueries(t *testing.T, store SpanStore) {
+	web := newTestSpan(100, 100, 100000000, "web", "get")
+	web.Annotations = append(web.Annotations, &zipkincore.Annotation{
+		Timestamp: 100000000,
+		Value:     "error",
+		Host:      web.Annotations[0].Host,
+	})
+	db := newTestSpan(100, 101, 100000005, "db", "select")
+	db.BinaryAnnotations = append(db.BinaryAnnotations, &zipkincore.BinaryAnnotation{
+		Key:            "http.status_code",
+		Value:          []byte("503"),
+		AnnotationType: zipkincore.AnnotationType_STRING,
+		Host:           db.Annotations[0].Host,
+	})
+	for _, span := range []*zipkincore.Span{web, db} {
+		if err := store.Append(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		query Query
+		want  []int64
+	}{
+		{Query{ServiceName: "db", Annotations: []string{"error"}}, []int64{}},
+		{Query{ServiceName: "web", Annotations: []string{"error"}}, []int64{100}},
+		{Query{ServiceName: "db", BinaryAnnotations: map[string]string{"http.status_code": "503"}}, []int64{100}},
+		{Query{Annotations: []string{"error"}, BinaryAnnotations: map[string]string{"http.status_code": "503"}}, []int64{}},
+	} {
+		tc.query.StartMS, tc.query.EndMS, tc.query.Limit = 0, 1<<40, 10
+		traces, err := store.Traces(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := traceIDs(traces); !reflect.DeepEqual(tc.want, have) {
+			t.Fatalf("%+v: %s", tc.query, diff(tc.want, have))
+		}
+	}
+}
+
+func TestBoltDBTagQueries(t *testing.T) {
+	store, cleanup := newTestBoltDB(t)
+	defer cleanup()
+
+	for i := int64(1); i <= 12; i++ {
+		if err := store.Append(newTaggedTestSpan(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testTagQueries(t, store)
+	testSpanTagQueries(t, store)
+}
+
+func TestInMemoryTagQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpanStore(Config{BlocksDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 12; i++ {
+		if err := s.Append(newTaggedTestSpan(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testTagQueries(t, s)
+
+	// Closing promotes the mutable block to disk, so this checks the disk
+	// block's postings.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewSpanStore(Config{BlocksDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testTagQueries(t, s)
+	testSpanTagQueries(t, s)
+}
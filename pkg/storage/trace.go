@@ -1,14 +1,17 @@
 package storage
 
 import (
+	"bytes"
 	"sort"
 
 	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/weaveworks-experiments/loki/pkg/model"
 )
 
 type Trace struct {
-	ID           int64
+	ID           model.TraceID
 	MinTimestamp int64 // in microseconds
 	MaxTimestamp int64
 	Spans        []*zipkincore.Span
@@ -16,7 +19,7 @@ type Trace struct {
 
 func newTrace(span *zipkincore.Span) *Trace {
 	return &Trace{
-		ID:           span.GetTraceID(),
+		ID:           model.ZipkinTraceID(span),
 		MinTimestamp: span.GetTimestamp(),
 		MaxTimestamp: span.GetTimestamp() + span.GetDuration(),
 		Spans:        []*zipkincore.Span{span},
@@ -37,17 +40,69 @@ func (t *Trace) addSpan(span *zipkincore.Span) {
 	}
 }
 
+// hasSpan returns whether the trace already holds a copy of span, as when a
+// scraper resends a batch it couldn't acknowledge.
+func (t *Trace) hasSpan(span *zipkincore.Span) bool {
+	for _, s := range t.Spans {
+		if sameSpan(s, span) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameSpan returns whether two spans of a trace are copies.  The client and
+// server sides of an RPC share an ID, so their annotations must match too.
+func sameSpan(a, b *zipkincore.Span) bool {
+	if a.ID != b.ID || a.GetTimestamp() != b.GetTimestamp() {
+		return false
+	}
+	abuf, err := encodeSpan(a)
+	if err != nil {
+		return false
+	}
+	bbuf, err := encodeSpan(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(abuf, bbuf)
+}
+
+// uniqueSpans drops copies of spans, keeping the first.
+func uniqueSpans(spans []*zipkincore.Span) []*zipkincore.Span {
+	byID := map[int64][]*zipkincore.Span{}
+	result := spans[:0]
+outer:
+	for _, span := range spans {
+		for _, s := range byID[span.ID] {
+			if sameSpan(s, span) {
+				continue outer
+			}
+		}
+		byID[span.ID] = append(byID[span.ID], span)
+		result = append(result, span)
+	}
+	return result
+}
+
+// inWindow returns whether any of the trace is between startMS and endMS.
+func (t *Trace) inWindow(startMS, endMS int64) bool {
+	return t.MaxTimestamp/1000 >= startMS && t.MinTimestamp/1000 <= endMS
+}
+
 func (t *Trace) match(query Query) bool {
-	traceStartMS := t.MinTimestamp / 1000
-	traceEndMS := t.MaxTimestamp / 1000
-	if traceEndMS < query.StartMS || traceStartMS > query.EndMS {
-		log.Infof("dropping trace %d - out of time range (%d < %d || %d > %d)", t.ID, traceEndMS, query.StartMS, traceStartMS, query.EndMS)
+	if !t.inWindow(query.StartMS, query.EndMS) {
+		log.Infof("dropping trace %s - out of time range (%d < %d || %d > %d)", t.ID, t.MaxTimestamp/1000, query.StartMS, t.MinTimestamp/1000, query.EndMS)
 		return false
 	}
 
-	traceDuration := t.MaxTimestamp - t.MinTimestamp
+	traceDuration := t.duration()
 	if traceDuration < query.MinDurationUS {
-		log.Infof("dropping span %d - too short %d < %d", t.ID, traceDuration, query.MinDurationUS)
+		log.Infof("dropping trace %s - too short %d < %d", t.ID, traceDuration, query.MinDurationUS)
+		return false
+	}
+	if query.MaxDurationUS > 0 && traceDuration > query.MaxDurationUS {
+		log.Infof("dropping trace %s - too long %d > %d", t.ID, traceDuration, query.MaxDurationUS)
 		return false
 	}
 
@@ -87,9 +142,36 @@ func (t *Trace) match(query Query) bool {
 		}
 	}
 
-	return true
+	return t.hasTerms(query.ServiceName, query.terms())
 }
 
+func (t *Trace) duration() int64 {
+	return t.MaxTimestamp - t.MinTimestamp
+}
+
+// sortTraces sorts traces into the given order.  Traces of the same duration
+// are newest first.
+func sortTraces(traces []Trace, order SortOrder) {
+	switch order {
+	case SortOldest:
+		sort.Sort(byMinTimestamp(traces))
+	case SortLongest:
+		sort.Sort(sort.Reverse(byMinTimestamp(traces)))
+		sort.Stable(sort.Reverse(byDuration(traces)))
+	case SortShortest:
+		sort.Sort(sort.Reverse(byMinTimestamp(traces)))
+		sort.Stable(byDuration(traces))
+	default:
+		sort.Sort(sort.Reverse(byMinTimestamp(traces)))
+	}
+}
+
+type byDuration []Trace
+
+func (ts byDuration) Len() int           { return len(ts) }
+func (ts byDuration) Swap(i, j int)      { ts[i], ts[j] = ts[j], ts[i] }
+func (ts byDuration) Less(i, j int) bool { return ts[i].duration() < ts[j].duration() }
+
 type byMinTimestamp []Trace
 
 func (ts byMinTimestamp) Len() int           { return len(ts) }
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTracesSortOrders(t *testing.T) {
+	bolt, cleanup := newTestBoltDB(t)
+	defer cleanup()
+	memory, err := NewSpanStore(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memory.Close()
+
+	// Trace i starts at i seconds and lasts (i*7)%10 seconds.
+	for _, store := range []SpanStore{bolt, memory} {
+		for i := int64(1); i <= 9; i++ {
+			span := newTestSpan(i, i, i*1000000, "foo", "get")
+			duration := (i * 7 % 10) * 1000000
+			span.Duration = &duration
+			if err := store.Append(span); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		query Query
+		want  []int64
+	}{
+		{Query{Limit: 3}, []int64{9, 8, 7}},
+		{Query{Limit: 3, Sort: SortOldest}, []int64{1, 2, 3}},
+		{Query{Limit: 3, Sort: SortLongest}, []int64{7, 4, 1}},
+		{Query{Limit: 3, Sort: SortShortest}, []int64{3, 6, 9}},
+		{Query{Limit: 10, Sort: SortLongest, MinDurationUS: 2000000, MaxDurationUS: 5000000}, []int64{5, 2, 9, 6}},
+	} {
+		tc.query.ServiceName, tc.query.StartMS, tc.query.EndMS = "foo", 0, 1<<40
+		for _, store := range []SpanStore{bolt, memory} {
+			traces, err := store.Traces(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := traceIDs(traces); !reflect.DeepEqual(tc.want, have) {
+				t.Fatalf("%T %+v: %s", store, tc.query, diff(tc.want, have))
+			}
+		}
+	}
+
+	// Duration orders only choose from the newest candidates: traces 5 to 9.
+	defer func(n int) { maxSortCandidates = n }(maxSortCandidates)
+	maxSortCandidates = 5
+	query := Query{ServiceName: "foo", EndMS: 1 << 40, Limit: 3, Sort: SortLongest}
+	for _, store := range []SpanStore{bolt, memory} {
+		traces, err := store.Traces(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := []int64{7, 8, 5}, traceIDs(traces); !reflect.DeepEqual(want, have) {
+			t.Fatalf("%T: %s", store, diff(want, have))
+		}
+	}
+	query.ServiceName = ""
+	traces, err := bolt.Traces(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []int64{7, 8, 5}, traceIDs(traces); !reflect.DeepEqual(want, have) {
+		t.Fatalf("%s", diff(want, have))
+	}
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/openzipkin/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+	log "github.com/sirupsen/logrus"
+)
+
+// Segments are cut when they reach this size, as well as when the mutable
+// block is promoted.
+const walSegmentSize = 64 * 1024 * 1024
+
+// WAL segments are files named by their sequence number, containing records
+// of:
+//
+//	length (4 bytes), CRC32 of the data (4 bytes), data
+//
+// where the data is a thrift-encoded span.
+const walRecordHeaderLen = 8
+
+// walRange is the run of segments, first to last inclusive, holding a block's
+// spans.  Segments are numbered from 1, so the zero walRange is empty.
+type walRange struct {
+	first, last int
+}
+
+func (r walRange) empty() bool {
+	return r.first == 0
+}
+
+func (r walRange) covers(segment int) bool {
+	return !r.empty() && r.first <= segment && segment <= r.last
+}
+
+// merge returns the smallest range covering both r and other.
+func (r walRange) merge(other walRange) walRange {
+	if r.empty() {
+		return other
+	}
+	if other.empty() {
+		return r
+	}
+	if other.first < r.first {
+		r.first = other.first
+	}
+	if other.last > r.last {
+		r.last = other.last
+	}
+	return r
+}
+
+type wal struct {
+	mtx     sync.Mutex
+	dir     string
+	segment int
+	file    *os.File
+	size    int64
+}
+
+// openWAL opens the WAL in dir, and starts a new segment for writing.  New
+// segments are numbered past the existing ones and past after, the last
+// segment held by a persisted block, so a truncated WAL never reuses a number
+// a block covers.
+func openWAL(dir string, after int) (*wal, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	segments, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{dir: dir, segment: after}
+	if len(segments) > 0 {
+		if last := segments[len(segments)-1]; last > w.segment {
+			w.segment = last
+		}
+	}
+	if _, err := w.cut(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// walSegments returns the sequence numbers of the segments in dir, in order.
+func walSegments(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+	for _, file := range files {
+		segment, err := strconv.Atoi(file.Name())
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (w *wal) segmentPath(segment int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d", segment))
+}
+
+// cut closes the current segment and starts a new one, returning the new
+// segment's sequence number.
+func (w *wal) cut() (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.cutLocked()
+}
+
+func (w *wal) cutLocked() (int, error) {
+	if w.file != nil {
+		if err := w.file.Sync(); err != nil {
+			return 0, err
+		}
+		if err := w.file.Close(); err != nil {
+			return 0, err
+		}
+	}
+	w.segment++
+	f, err := os.OpenFile(w.segmentPath(w.segment), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, err
+	}
+	w.file = f
+	w.size = 0
+	return w.segment, nil
+}
+
+// log appends a span to the current segment.
+func (w *wal) log(span *zipkincore.Span) error {
+	data, err := encodeSpan(span)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, walRecordHeaderLen+len(data))
+	binary.BigEndian.PutUint32(record[0:], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(data))
+	copy(record[walRecordHeaderLen:], data)
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.size+int64(len(record)) > walSegmentSize {
+		if _, err := w.cutLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.Write(record)
+	w.size += int64(n)
+	return err
+}
+
+// sync flushes the current segment to disk.  Until then, logged spans are
+// only in the page cache.
+func (w *wal) sync() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.file.Sync()
+}
+
+// truncate deletes all the segments before segment.
+func (w *wal) truncate(segment int) error {
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s >= segment {
+			break
+		}
+		if err := os.Remove(w.segmentPath(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay calls f with every span in the WAL, oldest first, except those in
+// segments skip says are already persisted.  It returns the first segment
+// replayed.  A torn record at the end of a segment, as left by a crash, ends
+// the replay of that segment.
+func (w *wal) replay(skip func(segment int) bool, f func(*zipkincore.Span) error) (int, error) {
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return 0, err
+	}
+	first := w.segment
+	for _, segment := range segments {
+		if segment >= w.segment {
+			break
+		}
+		if skip(segment) {
+			continue
+		}
+		if segment < first {
+			first = segment
+		}
+		if err := w.replaySegment(segment, f); err != nil {
+			return 0, err
+		}
+	}
+	return first, nil
+}
+
+func (w *wal) replaySegment(segment int, f func(*zipkincore.Span) error) error {
+	file, err := os.Open(w.segmentPath(segment))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	var header [walRecordHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			log.Warnf("Torn WAL record header in segment %d: %v", segment, err)
+			return nil
+		}
+		length := binary.BigEndian.Uint32(header[0:])
+		if length > walSegmentSize {
+			log.Warnf("Corrupt WAL record length in segment %d", segment)
+			return nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			log.Warnf("Torn WAL record in segment %d: %v", segment, err)
+			return nil
+		}
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+			log.Warnf("Corrupt WAL record in segment %d", segment)
+			return nil
+		}
+		span, err := decodeSpan(data)
+		if err != nil {
+			return err
+		}
+		if err := f(span); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *wal) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}